@@ -0,0 +1,382 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// ルールの種類
+// stuck=Statusのまま Minutes分以上経過
+// igs=Statusに達してから Minutes分以上経ってもIGSステータスが0でない
+// regress=これまでより前のステータスに戻った。Minutes分経っても戻らなければ新しいステータスとして受け入れる(0なら戻るまで)
+const (
+	alertStuck   = "stuck"
+	alertIgs     = "igs"
+	alertRegress = "regress"
+)
+
+const (
+	alertOpen     = "open"
+	alertResolved = "resolved"
+)
+
+// 解決済みとして保持しておく件数
+const maxResolvedAlerts = 200
+
+type alertRule struct {
+	Name    string `json:"name"`
+	Kind    string `json:"kind"`
+	Status  string `json:"status"`
+	Minutes int    `json:"minutes"`
+	Label   string `json:"label"`
+}
+
+type Alert struct {
+	ID          string     `json:"id"`
+	Rule        string     `json:"rule"`
+	Label       string     `json:"label"`
+	Awbno       string     `json:"awbno"`
+	StatusCode  string     `json:"status_code"`
+	IgsStatus   string     `json:"igs_status"`
+	SectionCode string     `json:"section_code"`
+	CompanyCode string     `json:"company_code"`
+	CompanyName string     `json:"company_name"`
+	Message     string     `json:"message"`
+	State       string     `json:"state"`
+	OpenedAt    time.Time  `json:"opened_at"`
+	ResolvedAt  *time.Time `json:"resolved_at"`
+}
+
+type AlertsResponce struct {
+	Active   []Alert `json:"active"`
+	Resolved []Alert `json:"resolved"`
+}
+
+var alertRules []alertRule
+
+// AlertRules=名前:種類:ステータス:分:表示名 をカンマ区切りで指定する。offなら評価しない
+func loadAlertSettings(settings map[string]string) error {
+	v := settings["AlertRules"]
+	if v == "" {
+		v = "stuck50:stuck:50:60:ステータス50のまま60分経過,stuck75:stuck:75:60:ステータス75のまま60分経過,igs75:igs:75:30:75到達後IGS未完了,regress:regress::60:ステータス後退"
+	}
+	alertRules = make([]alertRule, 0, 4)
+	if v == "off" {
+		return nil
+	}
+	names := make(map[string]bool)
+	for _, def := range strings.Split(v, ",") {
+		parts := strings.SplitN(strings.TrimSpace(def), ":", 5)
+		if len(parts) < 4 || parts[0] == "" {
+			return errors.New("AlertRulesが不正です:" + def)
+		}
+		if names[parts[0]] {
+			return errors.New("AlertRulesの名前が重複しています:" + parts[0])
+		}
+		names[parts[0]] = true
+		rule := alertRule{Name: parts[0], Kind: parts[1], Status: parts[2], Label: parts[0]}
+		switch rule.Kind {
+		case alertStuck, alertIgs:
+			if rule.Status == "" {
+				return errors.New("AlertRulesのステータスが指定されていません:" + def)
+			}
+		case alertRegress:
+		default:
+			return errors.New("AlertRulesの種類が不正です:" + def)
+		}
+		if parts[3] != "" {
+			n, err := strconv.Atoi(parts[3])
+			if err != nil || n < 0 {
+				return errors.New("AlertRulesの分が不正です:" + def)
+			}
+			rule.Minutes = n
+		}
+		if len(parts) == 5 && parts[4] != "" {
+			rule.Label = parts[4]
+		}
+		alertRules = append(alertRules, rule)
+	}
+	return nil
+}
+
+// AWBごとに現在のステータスになった時刻などを覚えておく
+// 初めて見たAWBは格納先の履歴から作るため、再起動しても経過時間は引き継がれる
+type awbTrack struct {
+	status string
+	since  time.Time
+	//これまでで最も進んだステータスと、各ステータスに初めて達した時刻
+	max     string
+	reached map[string]time.Time
+}
+
+type alertEngine struct {
+	mu sync.Mutex
+	//履歴を参照する格納先。nilの場合は最初に読み込んだ時刻から数える
+	store    StatusStore
+	tracks   map[string]*awbTrack
+	active   map[string]*Alert
+	resolved []Alert
+}
+
+var alerts = &alertEngine{tracks: make(map[string]*awbTrack), active: make(map[string]*Alert)}
+
+func (t *awbTrack) update(status AwbStatus, now time.Time) {
+	if t.status != status.StatusCode {
+		t.status = status.StatusCode
+		t.since = now
+	}
+	if t.max == "" || statusBefore(t.max, status.StatusCode) {
+		t.max = status.StatusCode
+	}
+	if _, ok := t.reached[status.StatusCode]; !ok {
+		t.reached[status.StatusCode] = now
+	}
+}
+
+// 後退を受け入れるまでの分数。0なら受け入れない
+func regressAcceptMinutes() float64 {
+	for _, rule := range alertRules {
+		if rule.Kind == alertRegress {
+			return float64(rule.Minutes)
+		}
+	}
+	return 0
+}
+
+// 格納先の履歴から現在のステータスになった時刻と各ステータスに初めて達した時刻を復元する
+// 戻らないまま一定時間経った後退は評価と同じく受け入れたものとする
+func trackFromHistory(carried *StsDoc, docs []StsDoc, now time.Time) *awbTrack {
+	if carried != nil {
+		docs = append([]StsDoc{*carried}, docs...)
+	}
+	entries := collapseHistory(docs, now.UnixMilli())
+	if len(entries) < 1 {
+		return nil
+	}
+	accept := regressAcceptMinutes()
+	t := &awbTrack{reached: make(map[string]time.Time)}
+	for _, en := range entries {
+		if _, ok := t.reached[en.StatusCode]; !ok {
+			t.reached[en.StatusCode] = en.EnteredAt
+		}
+		if t.max == "" || statusBefore(t.max, en.StatusCode) {
+			t.max = en.StatusCode
+		} else if statusBefore(en.StatusCode, t.max) && accept > 0 && en.DurationMinutes >= accept {
+			t.max = en.StatusCode
+		}
+	}
+	last := entries[len(entries)-1]
+	t.status, t.since = last.StatusCode, last.EnteredAt
+	return t
+}
+
+// まだ追跡していないAWBの追跡を格納先の履歴から作る
+func (e *alertEngine) seedTracks(awbs map[string]AwbStatus, now time.Time) map[string]*awbTrack {
+	if e.store == nil {
+		return nil
+	}
+	e.mu.Lock()
+	awbnos := make([]string, 0, 10)
+	for awb := range awbs {
+		if _, ok := e.tracks[awb]; !ok {
+			awbnos = append(awbnos, awb)
+		}
+	}
+	e.mu.Unlock()
+	if len(awbnos) < 1 {
+		return nil
+	}
+	sort.Strings(awbnos)
+	carried, histories, err := historiesWithCarry(e.store, awbnos, now.UnixMilli()-carryForwardWindow, now.UnixMilli())
+	if err != nil {
+		log.Printf("履歴を取得できません。読み込んだ時刻から経過時間を数えます:%s", err)
+		return nil
+	}
+	result := make(map[string]*awbTrack, len(awbnos))
+	for _, awb := range awbnos {
+		if t := trackFromHistory(carried[awb], histories[awb], now); t != nil {
+			result[awb] = t
+		}
+	}
+	return result
+}
+
+// ruleのStatus以上に初めて達した時刻
+func (t *awbTrack) reachedAt(status string) (time.Time, bool) {
+	var at time.Time
+	found := false
+	for code, tm := range t.reached {
+		if !statusBefore(code, status) && (!found || tm.Before(at)) {
+			at, found = tm, true
+		}
+	}
+	return at, found
+}
+
+// 条件に当てはまる場合はメッセージを返す
+func (r alertRule) check(status AwbStatus, t *awbTrack, now time.Time) (string, bool) {
+	limit := time.Duration(r.Minutes) * time.Minute
+	switch r.Kind {
+	case alertStuck:
+		if status.StatusCode == r.Status && now.Sub(t.since) >= limit {
+			return "ステータス" + r.Status + "のまま" + strconv.Itoa(int(now.Sub(t.since).Minutes())) + "分経過しています", true
+		}
+	case alertIgs:
+		at, ok := t.reachedAt(r.Status)
+		if ok && !statusBefore(status.StatusCode, r.Status) && status.IgsStatus != "0" && now.Sub(at) >= limit {
+			return "ステータス" + r.Status + "に達してから" + strconv.Itoa(int(now.Sub(at).Minutes())) + "分経ってもIGSステータスが" + status.IgsStatus + "です", true
+		}
+	case alertRegress:
+		if statusBefore(status.StatusCode, t.max) {
+			return "ステータスが" + t.max + "から" + status.StatusCode + "に戻りました", true
+		}
+	}
+	return "", false
+}
+
+// 取り込みごとに評価し、発生・解決したアラートを返す
+func (e *alertEngine) evaluate(awbs map[string]AwbStatus, now time.Time) []Alert {
+	seeded := e.seedTracks(awbs, now)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	events := make([]Alert, 0, 10)
+	for awb, status := range awbs {
+		t, ok := e.tracks[awb]
+		if !ok {
+			if t = seeded[awb]; t == nil {
+				t = &awbTrack{reached: make(map[string]time.Time)}
+			}
+			e.tracks[awb] = t
+		}
+		t.update(status, now)
+		for _, rule := range alertRules {
+			id := rule.Name + ":" + awb
+			a, active := e.active[id]
+			msg, hit := rule.check(status, t, now)
+			//戻らないまま一定時間経った後退は受け入れる
+			if hit && active && rule.Kind == alertRegress && rule.Minutes > 0 && now.Sub(a.OpenedAt) >= time.Duration(rule.Minutes)*time.Minute {
+				t.max = status.StatusCode
+				hit = false
+			}
+			switch {
+			case hit && !active:
+				a = &Alert{
+					ID:          id,
+					Rule:        rule.Name,
+					Label:       rule.Label,
+					Awbno:       awb,
+					StatusCode:  status.StatusCode,
+					IgsStatus:   status.IgsStatus,
+					SectionCode: status.SectionCode,
+					CompanyCode: status.CompanyCode,
+					CompanyName: status.CompanyName,
+					Message:     msg,
+					State:       alertOpen,
+					OpenedAt:    now,
+				}
+				e.active[id] = a
+				events = append(events, *a)
+				log.Printf("アラートが発生しました:%s %s %s", rule.Label, awb, msg)
+			case hit && active:
+				a.StatusCode, a.IgsStatus, a.Message = status.StatusCode, status.IgsStatus, msg
+			case !hit && active:
+				events = append(events, e.resolve(id, now))
+			}
+		}
+	}
+	//一覧からなくなったAWBのアラートは解決済みにする
+	for id, a := range e.active {
+		if _, ok := awbs[a.Awbno]; !ok {
+			events = append(events, e.resolve(id, now))
+		}
+	}
+	for awb := range e.tracks {
+		if _, ok := awbs[awb]; !ok {
+			delete(e.tracks, awb)
+		}
+	}
+	return events
+}
+
+// 呼び出し側でロックを取得しておくこと
+func (e *alertEngine) resolve(id string, now time.Time) Alert {
+	a := e.active[id]
+	delete(e.active, id)
+	a.State = alertResolved
+	a.ResolvedAt = &now
+	if len(e.resolved) >= maxResolvedAlerts {
+		e.resolved = e.resolved[1:]
+	}
+	e.resolved = append(e.resolved, *a)
+	log.Printf("アラートが解決しました:%s %s", a.Label, a.Awbno)
+	return *a
+}
+
+// AWBごとの現在のステータスになった時刻
+func (e *alertEngine) statusSince() map[string]time.Time {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	result := make(map[string]time.Time, len(e.tracks))
+	for awb, t := range e.tracks {
+		result[awb] = t.since
+	}
+	return result
+}
+
+// 発生が古い順
+func (e *alertEngine) list() []Alert {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	result := make([]Alert, 0, len(e.active))
+	for _, a := range e.active {
+		result = append(result, *a)
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		if !result[i].OpenedAt.Equal(result[j].OpenedAt) {
+			return result[i].OpenedAt.Before(result[j].OpenedAt)
+		}
+		return result[i].ID < result[j].ID
+	})
+	return result
+}
+
+// 解決が新しい順
+func (e *alertEngine) recentResolved() []Alert {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	result := make([]Alert, 0, len(e.resolved))
+	for i := len(e.resolved) - 1; i >= 0; i-- {
+		result = append(result, e.resolved[i])
+	}
+	return result
+}
+
+// rule,section=絞り込み。resolved=trueなら最近解決したアラートも返す
+func alertsApi(c echo.Context) error {
+	match := func(a Alert) bool {
+		return (c.QueryParam("rule") == "" || c.QueryParam("rule") == a.Rule) &&
+			(c.QueryParam("section") == "" || c.QueryParam("section") == a.SectionCode)
+	}
+	result := AlertsResponce{Active: make([]Alert, 0, 10), Resolved: make([]Alert, 0)}
+	for _, a := range alerts.list() {
+		if match(a) {
+			result.Active = append(result.Active, a)
+		}
+	}
+	if c.QueryParam("resolved") == "true" {
+		for _, a := range alerts.recentResolved() {
+			if match(a) {
+				result.Resolved = append(result.Resolved, a)
+			}
+		}
+	}
+	return c.JSON(http.StatusOK, result)
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAlertEngineEvaluate(t *testing.T) {
+	if err := loadAlertSettings(map[string]string{
+		"AlertRules": "stuck50:stuck:50:60,igs75:igs:75:30,regress:regress::60",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	defer loadAlertSettings(map[string]string{})
+	e := &alertEngine{tracks: make(map[string]*awbTrack), active: make(map[string]*Alert)}
+	t0 := time.Now()
+	awbs := func(sts1, sts2, igs2 string) map[string]AwbStatus {
+		return map[string]AwbStatus{
+			"1": {Awbno: "1", StatusCode: sts1},
+			"2": {Awbno: "2", StatusCode: sts2, IgsStatus: igs2},
+		}
+	}
+
+	if events := e.evaluate(awbs("50", "75", "-1"), t0); len(events) != 0 {
+		t.Fatalf("最初の評価で発生しています:%+v", events)
+	}
+	events := e.evaluate(awbs("50", "75", "-1"), t0.Add(31*time.Minute))
+	if len(events) != 1 || events[0].Rule != "igs75" || events[0].State != alertOpen || events[0].Awbno != "2" {
+		t.Fatalf("IGS未完了のアラートが違います:%+v", events)
+	}
+	//IGSが完了すると解決し、50のままのAWBは発生する
+	events = e.evaluate(awbs("50", "75", "0"), t0.Add(61*time.Minute))
+	if len(events) != 2 {
+		t.Fatalf("アラートが違います:%+v", events)
+	}
+	if list := e.list(); len(list) != 1 || list[0].Rule != "stuck50" {
+		t.Fatalf("発生中のアラートが違います:%+v", list)
+	}
+	if resolved := e.recentResolved(); len(resolved) != 1 || resolved[0].Rule != "igs75" || resolved[0].ResolvedAt == nil {
+		t.Fatalf("解決済みのアラートが違います:%+v", resolved)
+	}
+
+	//ステータスが進むと解決する。前のステータスに戻ると後退として発生する
+	if events = e.evaluate(awbs("70", "80", "0"), t0.Add(62*time.Minute)); len(events) != 1 || events[0].State != alertResolved {
+		t.Fatalf("アラートが違います:%+v", events)
+	}
+	events = e.evaluate(awbs("70", "75", "0"), t0.Add(63*time.Minute))
+	if len(events) != 1 || events[0].Rule != "regress" || events[0].State != alertOpen {
+		t.Fatalf("後退のアラートが違います:%+v", events)
+	}
+	//戻らないまま時間が経った後退は受け入れる
+	events = e.evaluate(awbs("70", "75", "0"), t0.Add(130*time.Minute))
+	if len(events) != 1 || events[0].Rule != "regress" || events[0].State != alertResolved {
+		t.Fatalf("後退の受け入れが違います:%+v", events)
+	}
+
+	//一覧からなくなったAWBは解決し、追跡もやめる
+	if events = e.evaluate(awbs("50", "75", "0"), t0.Add(131*time.Minute)); len(events) != 1 || events[0].Awbno != "1" {
+		t.Fatalf("後退のアラートが違います:%+v", events)
+	}
+	events = e.evaluate(map[string]AwbStatus{}, t0.Add(200*time.Minute))
+	if len(events) != 1 || len(e.tracks) != 0 || len(e.active) != 0 {
+		t.Fatalf("なくなったAWBの扱いが違います:%+v", events)
+	}
+}
+
+func TestAlertTracksSeededFromStore(t *testing.T) {
+	if err := loadAlertSettings(map[string]string{
+		"AlertRules": "stuck50:stuck:50:60,igs75:igs:75:30,regress:regress::60",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	defer loadAlertSettings(map[string]string{})
+	s := newMemStore()
+	now := time.Now()
+	at := func(d time.Duration) int64 { return now.Add(d).UnixMilli() }
+	s.Append([]StsDoc{
+		//再起動前から50のまま
+		{Awbno: "1", StatusCode: "50", UpdateTime: at(-90 * time.Minute), Event: eventChanged},
+		{Awbno: "1", StatusCode: "50", UpdateTime: at(-30 * time.Minute), Event: eventHeartbeat},
+		//受け入れ済みの後退
+		{Awbno: "2", StatusCode: "80", UpdateTime: at(-3 * time.Hour), Event: eventChanged},
+		{Awbno: "2", StatusCode: "75", UpdateTime: at(-2 * time.Hour), Event: eventChanged, IgsStatus: "0"},
+		//受け入れ前の後退
+		{Awbno: "3", StatusCode: "80", UpdateTime: at(-40 * time.Minute), Event: eventChanged},
+		{Awbno: "3", StatusCode: "75", UpdateTime: at(-10 * time.Minute), Event: eventChanged, IgsStatus: "0"},
+		//75に達してからIGSが終わっていない
+		{Awbno: "4", StatusCode: "75", UpdateTime: at(-45 * time.Minute), Event: eventChanged, IgsStatus: "-1"},
+	})
+	e := &alertEngine{store: s, tracks: make(map[string]*awbTrack), active: make(map[string]*Alert)}
+	events := e.evaluate(map[string]AwbStatus{
+		"1": {Awbno: "1", StatusCode: "50"},
+		"2": {Awbno: "2", StatusCode: "75", IgsStatus: "0"},
+		"3": {Awbno: "3", StatusCode: "75", IgsStatus: "0"},
+		"4": {Awbno: "4", StatusCode: "75", IgsStatus: "-1"},
+		"5": {Awbno: "5", StatusCode: "50"},
+	}, now)
+	fired := make(map[string]string)
+	for _, ev := range events {
+		fired[ev.Awbno] = ev.Rule
+	}
+	if len(events) != 3 || fired["1"] != "stuck50" || fired["3"] != "regress" || fired["4"] != "igs75" {
+		t.Fatalf("再起動後のアラートが違います:%+v", events)
+	}
+	since := e.statusSince()
+	if !since["1"].Equal(time.UnixMilli(at(-90*time.Minute))) || !since["5"].Equal(now) {
+		t.Fatalf("ステータスになった時刻が違います:%v", since)
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+var archiveFolderPath string
+var importKeepDays int
+
+// 取り込んだ日と取り込んだ時刻をアーカイブフォルダに記録しておく
+const importedDaysFileName = `imported_days.json`
+
+// ImportKeepDays=アーカイブから取り込んだ日を、保存期間を過ぎていても取り込んでから残しておく日数
+func loadArchiveSettings(settings map[string]string) error {
+	//未設定の場合は保存期間を過ぎた日をアーカイブせずに削除する(削除した日ごとに警告を出す)
+	archiveFolderPath = settings["ArchiveFolderPath"]
+	importKeepDays = 7
+	if v := settings["ImportKeepDays"]; v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return errors.New("ImportKeepDaysが不正です:" + v)
+		}
+		importKeepDays = n
+	}
+	return nil
+}
+
+// ArchiveFolderPathが未設定の場合は記録しないため、取り込んだ日も次の削除で削除される
+func loadImportedDays() (map[string]time.Time, error) {
+	days := make(map[string]time.Time)
+	if archiveFolderPath == "" {
+		return days, nil
+	}
+	b, err := ioutil.ReadFile(filepath.Join(archiveFolderPath, importedDaysFileName))
+	if os.IsNotExist(err) {
+		return days, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &days); err != nil {
+		return nil, err
+	}
+	return days, nil
+}
+
+func saveImportedDays(days map[string]time.Time) error {
+	if archiveFolderPath == "" {
+		return nil
+	}
+	if err := os.MkdirAll(archiveFolderPath, 0755); err != nil {
+		return err
+	}
+	b, err := json.Marshal(days)
+	if err != nil {
+		return err
+	}
+	name := filepath.Join(archiveFolderPath, importedDaysFileName)
+	if err := ioutil.WriteFile(name+`.tmp`, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(name+`.tmp`, name)
+}
+
+// 日毎の全件をgzip圧縮したNDJSON(sts_index_YYYYMMDD.ndjson.gz)に書き出す
+// ArchiveFolderPathが未設定の場合はエラーにする
+func archiveDay(s StatusStore, day string) error {
+	if archiveFolderPath == "" {
+		return errors.New("ArchiveFolderPathが設定されていません")
+	}
+	if err := os.MkdirAll(archiveFolderPath, 0755); err != nil {
+		return err
+	}
+	name := filepath.Join(archiveFolderPath, `sts_index_`+day+`.ndjson.gz`)
+	tmp := name + `.tmp`
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	err = func() error {
+		defer f.Close()
+		zw := gzip.NewWriter(f)
+		enc := json.NewEncoder(zw)
+		cntr := 0
+		if err := s.EachDoc(day, func(doc StsDoc) error {
+			cntr++
+			return enc.Encode(doc)
+		}); err != nil {
+			return err
+		}
+		if err := zw.Close(); err != nil {
+			return err
+		}
+		log.Printf("アーカイブを作成しました:%s %d件", name, cntr)
+		return nil
+	}()
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, name)
+}
+
+// archiveDayで作成したファイルを読み込み、格納先へ登録し直す
+// 登録先はupdate_timeの日の格納先になる。格納先に既にある記録は登録しないため、同じファイルを2回取り込んでも重複しない
+// 戻り値は新たに登録した件数
+func importArchive(s StatusStore, name string) (int, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		return 0, err
+	}
+	defer zr.Close()
+	//日ごとに格納先にある記録のキー
+	existing := make(map[string]map[string]bool)
+	dayKeys := func(day string) (map[string]bool, error) {
+		if keys, ok := existing[day]; ok {
+			return keys, nil
+		}
+		keys := make(map[string]bool)
+		if err := s.EachDoc(day, func(doc StsDoc) error {
+			keys[stsDocKey(doc)] = true
+			return nil
+		}); err != nil {
+			return nil, err
+		}
+		existing[day] = keys
+		return keys, nil
+	}
+	maxImport := 1000
+	docs := make([]StsDoc, 0, maxImport)
+	cntr := 0
+	sc := bufio.NewScanner(zr)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	for sc.Scan() {
+		if len(sc.Bytes()) == 0 {
+			continue
+		}
+		var doc StsDoc
+		if err := json.Unmarshal(sc.Bytes(), &doc); err != nil {
+			return cntr, err
+		}
+		keys, err := dayKeys(time.UnixMilli(doc.UpdateTime).Local().Format("20060102"))
+		if err != nil {
+			return cntr, err
+		}
+		if keys[stsDocKey(doc)] {
+			continue
+		}
+		keys[stsDocKey(doc)] = true
+		docs = append(docs, doc)
+		if len(docs) >= maxImport {
+			if err := s.Append(docs); err != nil {
+				return cntr, err
+			}
+			cntr += len(docs)
+			docs = docs[:0]
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return cntr, err
+	}
+	if len(docs) > 0 {
+		if err := s.Append(docs); err != nil {
+			return cntr, err
+		}
+		cntr += len(docs)
+	}
+	//保存期間を過ぎた日でもすぐに削除されないように取り込んだ日を記録する
+	imported, err := loadImportedDays()
+	if err != nil {
+		return cntr, err
+	}
+	now := time.Now()
+	for day := range existing {
+		imported[day] = now
+	}
+	return cntr, saveImportedDays(imported)
+}
+
+// アーカイブの再取り込み(stschecker import <アーカイブファイル>...)
+// 保存期間を過ぎた日の分は取り込んでからImportKeepDays日経った後の削除時に、再度アーカイブされてから削除される
+func runImport(names []string) error {
+	if err := GetSettings(); err != nil {
+		return err
+	}
+	store, err := newStatusStore(storeType)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		cntr, err := importArchive(store, name)
+		if err != nil {
+			return err
+		}
+		log.Printf("アーカイブを取り込みました:%s %d件", name, cntr)
+	}
+	return nil
+}
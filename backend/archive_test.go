@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestArchiveImport(t *testing.T) {
+	dir := t.TempDir()
+	if err := loadArchiveSettings(map[string]string{"ArchiveFolderPath": filepath.Join(dir, "archive")}); err != nil {
+		t.Fatal(err)
+	}
+	defer loadArchiveSettings(map[string]string{})
+	s, err := newFileStore(filepath.Join(dir, "store"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Prepare(); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().AddDate(0, 0, -10)
+	now := time.Now()
+	s.Append([]StsDoc{
+		{Awbno: "A", StatusCode: "50", UpdateTime: old.UnixMilli(), Event: eventChanged},
+		{Awbno: "A", StatusCode: "70", UpdateTime: old.Add(10 * time.Minute).UnixMilli(), Event: eventChanged},
+		{Awbno: "A", StatusCode: "72", UpdateTime: now.UnixMilli(), Event: eventChanged},
+	})
+	if err := s.Purge(3); err != nil {
+		t.Fatal(err)
+	}
+	if days, _ := s.Days(); len(days) != 1 {
+		t.Fatalf("保存期間を過ぎた日が残っています:%v", days)
+	}
+	archive := filepath.Join(archiveFolderPath, "sts_index_"+old.Format("20060102")+".ndjson.gz")
+
+	//2回取り込んでも重複しない
+	for i, want := range []int{2, 0} {
+		n, err := importArchive(s, archive)
+		if err != nil || n != want {
+			t.Fatalf("%d回目の取り込み件数が違います:%d %v", i+1, n, err)
+		}
+	}
+	h, err := s.History("A", old.UnixMilli()-1, now.UnixMilli())
+	if err != nil || len(h) != 3 {
+		t.Fatalf("履歴が違います:%+v %v", h, err)
+	}
+
+	//取り込んだ日は保存期間を過ぎていてもImportKeepDays日は削除しない
+	if err := s.Purge(3); err != nil {
+		t.Fatal(err)
+	}
+	if days, _ := s.Days(); len(days) != 2 {
+		t.Fatalf("取り込んだ日が削除されています:%v", days)
+	}
+	imported, err := loadImportedDays()
+	if err != nil || len(imported) != 1 {
+		t.Fatalf("取り込んだ日の記録が違います:%v %v", imported, err)
+	}
+	imported[old.Format("20060102")] = now.AddDate(0, 0, -importKeepDays-1)
+	if err := saveImportedDays(imported); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Purge(3); err != nil {
+		t.Fatal(err)
+	}
+	if days, _ := s.Days(); len(days) != 1 {
+		t.Fatalf("期間を過ぎた取り込み分が残っています:%v", days)
+	}
+	if imported, _ := loadImportedDays(); len(imported) != 0 {
+		t.Fatalf("削除した日の記録が残っています:%v", imported)
+	}
+	if _, err := ioutil.ReadFile(archive); err != nil {
+		t.Fatalf("アーカイブがありません:%v", err)
+	}
+}
+
+func TestPurgeWithoutArchiveFolder(t *testing.T) {
+	if err := loadArchiveSettings(map[string]string{}); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+	s := newMemStore()
+	old := time.Now().AddDate(0, 0, -10)
+	s.Append([]StsDoc{{Awbno: "A", StatusCode: "50", UpdateTime: old.UnixMilli(), Event: eventChanged}})
+	if err := s.Purge(3); err != nil {
+		t.Fatal(err)
+	}
+	if days, _ := s.Days(); len(days) != 0 {
+		t.Fatalf("保存期間を過ぎた日が残っています:%v", days)
+	}
+	//アーカイブせずに削除した日を警告する
+	if !strings.Contains(buf.String(), old.Format("20060102")) {
+		t.Fatalf("警告が出ていません:%s", buf.String())
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+)
+
+// AWB番号は英数字、枝番は"-"の後に英数字
+var awbNoPattern = regexp.MustCompile(`^[0-9A-Za-z]{1,20}$`)
+var awbBranchPattern = regexp.MustCompile(`^[0-9A-Za-z]{1,4}$`)
+
+// 画面から渡されたAWB番号(枝番付きの場合は"AWB-枝番")を確認し、格納されている形式にして返す
+// 枝番"0"は枝番なしとして扱う
+func normalizeAwbKey(key string) (string, error) {
+	key = strings.TrimSpace(key)
+	if key == "" {
+		return "", errors.New("AWB番号が指定されていません")
+	}
+	awb, branch := key, ""
+	if i := strings.Index(key, "-"); i >= 0 {
+		awb, branch = key[:i], key[i+1:]
+		if !awbBranchPattern.MatchString(branch) {
+			return "", errors.New("枝番の形式が不正です:" + key)
+		}
+	}
+	if !awbNoPattern.MatchString(awb) {
+		return "", errors.New("AWB番号の形式が不正です:" + key)
+	}
+	if branch == "" || branch == "0" {
+		return awb, nil
+	}
+	return awb + "-" + branch, nil
+}
@@ -0,0 +1,29 @@
+package main
+
+import "testing"
+
+func TestNormalizeAwbKey(t *testing.T) {
+	cases := []struct {
+		key, want string
+		ok        bool
+	}{
+		{"11111111", "11111111", true},
+		{" 11111111 ", "11111111", true},
+		{"11111111-0", "11111111", true},
+		{"11111111-A1", "11111111-A1", true},
+		{"", "", false},
+		{"11111111-", "", false},
+		{"11111111-12345", "", false},
+		{"11111111-1-2", "", false},
+		{"-1", "", false},
+		{"1111 1111", "", false},
+		{"123456789012345678901", "", false},
+		{"1111*", "", false},
+	}
+	for _, c := range cases {
+		got, err := normalizeAwbKey(c.key)
+		if (err == nil) != c.ok || got != c.want {
+			t.Errorf("%q:結果が違います:%q %v", c.key, got, err)
+		}
+	}
+}
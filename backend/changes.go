@@ -0,0 +1,152 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// StsDoc.Eventの値。空の場合は変更の有無に関わらず記録していた頃のスナップショット
+const (
+	eventChanged   = "changed"
+	eventRemoved   = "removed"
+	eventHeartbeat = "heartbeat"
+)
+
+// 変更がない間も状態を引き継いで扱う期間。これより前の記録は参照しない
+const carryForwardWindow = int64(24 * 60 * 60 * 1000)
+
+var heartbeatInterval time.Duration
+
+// HeartbeatInterval=変更がなくても全件を記録する間隔("1h"など)。未設定なら日付が変わった時と起動時のみ
+func loadChangeSettings(settings map[string]string) error {
+	heartbeatInterval = 0
+	if settings["HeartbeatInterval"] == "" {
+		return nil
+	}
+	d, err := durationSetting(settings, "HeartbeatInterval", 0)
+	if err != nil {
+		return err
+	}
+	heartbeatInterval = d
+	return nil
+}
+
+func isRemoved(doc StsDoc) bool {
+	return doc.Event == eventRemoved
+}
+
+// 前回の取り込みで記録した内容と比べて、変更のあった行だけを記録する
+type changeTracker struct {
+	store         StatusStore
+	last          map[string]StsDoc
+	lastHeartbeat time.Time
+	//格納先から前回分を取得できたか
+	seeded bool
+}
+
+func sameStatus(a, b StsDoc) bool {
+	return a.StatusCode == b.StatusCode &&
+		a.LastUserName == b.LastUserName &&
+		a.LastUserId == b.LastUserId &&
+		a.CompanyName == b.CompanyName &&
+		a.CompanyCode == b.CompanyCode &&
+		a.SectionCode == b.SectionCode &&
+		a.IsStocked == b.IsStocked &&
+		a.IgsStatus == b.IgsStatus
+}
+
+// 起動直後は格納先の最新の記録を前回分とする。消えたAWBを削除として記録するため
+// 取得できない場合は直前の取り込みの内容と比べ、次の取り込みで改めて取得する
+func (t *changeTracker) seed(now int64) {
+	docs, err := t.store.Latest(now-carryForwardWindow, now+1)
+	if err != nil {
+		log.Printf("前回のステータスを取得できません。次の取り込みで改めて取得します:%s", err)
+		return
+	}
+	last := make(map[string]StsDoc)
+	for _, doc := range docs {
+		if !isRemoved(doc) {
+			last[doc.Awbno] = doc
+		}
+	}
+	t.last = last
+	t.seeded = true
+}
+
+// 記録する変更を返す。heartbeatがtrueの場合は変更のない行も含める
+func (t *changeTracker) diff(docs []StsDoc, now time.Time) (events []StsDoc, heartbeat bool) {
+	if !t.seeded {
+		t.seed(now.UnixMilli())
+	}
+	last := t.last
+	y1, m1, d1 := t.lastHeartbeat.Date()
+	y2, m2, d2 := now.Date()
+	heartbeat = t.lastHeartbeat.IsZero() || y1 != y2 || m1 != m2 || d1 != d2 ||
+		(heartbeatInterval > 0 && now.Sub(t.lastHeartbeat) >= heartbeatInterval)
+
+	events = make([]StsDoc, 0, len(docs))
+	current := make(map[string]bool, len(docs))
+	for _, doc := range docs {
+		current[doc.Awbno] = true
+		prev, ok := last[doc.Awbno]
+		if !ok || !sameStatus(prev, doc) {
+			doc.Event = eventChanged
+		} else if heartbeat {
+			doc.Event = eventHeartbeat
+		} else {
+			continue
+		}
+		events = append(events, doc)
+	}
+	for awb, prev := range last {
+		if current[awb] {
+			continue
+		}
+		prev.UpdateTime = now.UnixMilli()
+		prev.Event = eventRemoved
+		events = append(events, prev)
+	}
+	return events, heartbeat
+}
+
+// 記録に成功した場合のみ前回分を更新する。失敗した変更は次の取り込みで改めて記録する
+func (t *changeTracker) commit(docs []StsDoc, now time.Time, heartbeat bool) {
+	last := make(map[string]StsDoc, len(docs))
+	for _, doc := range docs {
+		last[doc.Awbno] = doc
+	}
+	t.last = last
+	if heartbeat {
+		t.lastHeartbeat = now
+	}
+}
+
+// 期間内の記録と、fromの時点の状態(fromより前の最後の記録。削除済みならnil)を返す
+// 期間内の記録とは別に検索し、引き継ぐ記録が件数の上限で落ちないようにする
+func historyWithCarry(s StatusStore, awbno string, from, to int64) (*StsDoc, []StsDoc, error) {
+	carried, histories, err := historiesWithCarry(s, []string{awbno}, from, to)
+	if err != nil {
+		return nil, nil, err
+	}
+	return carried[awbno], histories[awbno], nil
+}
+
+// 複数のAWBをまとめて取得する。戻り値はAWB番号ごと
+func historiesWithCarry(s StatusStore, awbnos []string, from, to int64) (map[string]*StsDoc, map[string][]StsDoc, error) {
+	lasts, err := s.LatestOf(awbnos, from-carryForwardWindow, from)
+	if err != nil {
+		return nil, nil, err
+	}
+	histories, err := s.HistoryMany(awbnos, from, to)
+	if err != nil {
+		return nil, nil, err
+	}
+	carried := make(map[string]*StsDoc, len(lasts))
+	for awbno, doc := range lasts {
+		if !isRemoved(doc) {
+			doc := doc
+			carried[awbno] = &doc
+		}
+	}
+	return carried, histories, nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestChangeTrackerDiff(t *testing.T) {
+	s := newMemStore()
+	tr := &changeTracker{store: s}
+	base := testBaseTime()
+	mk := func(awb, code string, ts time.Time) StsDoc {
+		return StsDoc{Awbno: awb, StatusCode: code, UpdateTime: ts.UnixMilli()}
+	}
+	step := func(ts time.Time, docs ...StsDoc) []StsDoc {
+		events, heartbeat := tr.diff(docs, ts)
+		if err := s.Append(events); err != nil {
+			t.Fatal(err)
+		}
+		tr.commit(docs, ts, heartbeat)
+		return events
+	}
+
+	//最初の取り込みはすべて記録する
+	events := step(base, mk("A", "50", base), mk("B", "40", base))
+	if len(events) != 2 || events[0].Event != eventChanged || events[1].Event != eventChanged {
+		t.Fatalf("最初の記録が違います:%+v", events)
+	}
+	//変わった行だけを記録する
+	t1 := base.Add(90 * time.Second)
+	events = step(t1, mk("A", "50", t1), mk("B", "50", t1))
+	if len(events) != 1 || events[0].Awbno != "B" || events[0].StatusCode != "50" {
+		t.Fatalf("変更の記録が違います:%+v", events)
+	}
+	//一覧から消えたAWBは削除として記録する
+	t2 := base.Add(40 * time.Minute)
+	events = step(t2, mk("B", "70", t2))
+	if len(events) != 2 {
+		t.Fatalf("削除の記録が違います:%+v", events)
+	}
+	for _, ev := range events {
+		if ev.Awbno == "A" && (ev.Event != eventRemoved || ev.UpdateTime != t2.UnixMilli() || ev.StatusCode != "50") {
+			t.Fatalf("削除の記録が違います:%+v", ev)
+		}
+	}
+
+	//再起動後は格納先の最新の記録を前回分とする
+	tr = &changeTracker{store: s, lastHeartbeat: t2}
+	t3 := t2.Add(time.Minute)
+	if events = step(t3, mk("B", "70", t3)); len(events) != 0 {
+		t.Fatalf("再起動後に変更のない行を記録しています:%+v", events)
+	}
+	//日付が変わった後は変更のない行も記録する
+	tr.lastHeartbeat = t3.AddDate(0, 0, -1)
+	t4 := t3.Add(time.Minute)
+	if events = step(t4, mk("B", "70", t4)); len(events) != 1 || events[0].Event != eventHeartbeat {
+		t.Fatalf("定期記録が違います:%+v", events)
+	}
+}
+
+// 最初のfails回だけLatestに失敗する格納先
+type flakyLatestStore struct {
+	StatusStore
+	fails int
+}
+
+func (s *flakyLatestStore) Latest(from, to int64) ([]StsDoc, error) {
+	if s.fails > 0 {
+		s.fails--
+		return nil, errors.New("検索に失敗しました")
+	}
+	return s.StatusStore.Latest(from, to)
+}
+
+func TestChangeTrackerSeedRetry(t *testing.T) {
+	s := newMemStore()
+	base := testBaseTime()
+	s.Append([]StsDoc{
+		{Awbno: "A", StatusCode: "50", UpdateTime: base.UnixMilli(), Event: eventChanged},
+		{Awbno: "B", StatusCode: "40", UpdateTime: base.UnixMilli(), Event: eventChanged},
+	})
+	//再起動直後に前回分を取得できない
+	tr := &changeTracker{store: &flakyLatestStore{StatusStore: s, fails: 1}}
+	t1 := base.Add(time.Hour)
+	docs := []StsDoc{{Awbno: "B", StatusCode: "40", UpdateTime: t1.UnixMilli()}}
+	events, heartbeat := tr.diff(docs, t1)
+	if len(events) != 1 || events[0].Awbno != "B" {
+		t.Fatalf("取得できない間の記録が違います:%+v", events)
+	}
+	s.Append(events)
+	tr.commit(docs, t1, heartbeat)
+
+	//次の取り込みで取得し直し、停止中に消えたAWBを削除として記録する
+	t2 := t1.Add(time.Minute)
+	docs = []StsDoc{{Awbno: "B", StatusCode: "40", UpdateTime: t2.UnixMilli()}}
+	events, _ = tr.diff(docs, t2)
+	if len(events) != 1 || events[0].Awbno != "A" || events[0].Event != eventRemoved {
+		t.Fatalf("取得し直した後の記録が違います:%+v", events)
+	}
+}
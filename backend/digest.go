@@ -0,0 +1,399 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"net/smtp"
+	"sort"
+	"strconv"
+	"strings"
+	texttemplate "text/template"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// 部署ごとの宛先はDigestRecipients.<section_code>に指定する
+const digestSectionPrefix = "DigestRecipients."
+
+type digestCount struct {
+	StatusCode string
+	Label      string
+	Count      int
+}
+
+type digestWaiting struct {
+	Awbno       string
+	StatusCode  string
+	SectionCode string
+	CompanyName string
+	Since       time.Time
+	Minutes     int
+}
+
+// テンプレートに渡す内容。Sectionが空なら全部署
+type digestData struct {
+	Title        string
+	Section      string
+	From         time.Time
+	To           time.Time
+	Total        int
+	Statuses     []digestCount
+	Day          string
+	Stages       []StageMetrics
+	Waiting      []digestWaiting
+	LockRemovals []lockRemoval
+}
+
+const digestTextTemplate = `{{.Title}}{{if .Section}} 部署:{{.Section}}{{end}}
+期間:{{.From.Format "2006/01/02 15:04"}} - {{.To.Format "2006/01/02 15:04"}}
+
+■ステータス別件数(計{{.Total}}件)
+{{range .Statuses}}  {{.StatusCode}} {{.Label}}: {{.Count}}件
+{{else}}  なし
+{{end}}
+■所要時間(営業日{{.Day}}、全部署、分)
+{{range .Stages}}  {{.Label}}: {{.Count}}件 平均{{printf "%.1f" .Mean}} 中央値{{printf "%.1f" .Median}} 90%値{{printf "%.1f" .P90}}
+{{end}}
+■待ち時間が長いAWB
+{{range .Waiting}}  {{.Awbno}} ステータス{{.StatusCode}} {{.Minutes}}分 {{.CompanyName}} {{.SectionCode}}
+{{else}}  なし
+{{end}}
+■ロックファイルの強制削除
+{{range .LockRemovals}}  {{.Time.Format "01/02 15:04:05"}} {{.Lock}} {{.Lockfile}}
+{{else}}  なし
+{{end}}`
+
+const digestHtmlTemplate = `<html><body>
+<h2>{{.Title}}{{if .Section}} 部署:{{.Section}}{{end}}</h2>
+<p>期間:{{.From.Format "2006/01/02 15:04"}} - {{.To.Format "2006/01/02 15:04"}}</p>
+<h3>ステータス別件数(計{{.Total}}件)</h3>
+<table border="1" cellspacing="0" cellpadding="4">
+<tr><th>ステータス</th><th>件数</th></tr>
+{{range .Statuses}}<tr><td>{{.StatusCode}} {{.Label}}</td><td align="right">{{.Count}}</td></tr>
+{{end}}</table>
+<h3>所要時間(営業日{{.Day}}、全部署、分)</h3>
+<table border="1" cellspacing="0" cellpadding="4">
+<tr><th>区間</th><th>件数</th><th>平均</th><th>中央値</th><th>90%値</th></tr>
+{{range .Stages}}<tr><td>{{.Label}}</td><td align="right">{{.Count}}</td><td align="right">{{printf "%.1f" .Mean}}</td><td align="right">{{printf "%.1f" .Median}}</td><td align="right">{{printf "%.1f" .P90}}</td></tr>
+{{end}}</table>
+<h3>待ち時間が長いAWB</h3>
+{{if .Waiting}}<table border="1" cellspacing="0" cellpadding="4">
+<tr><th>AWB</th><th>ステータス</th><th>経過(分)</th><th>会社</th><th>部署</th></tr>
+{{range .Waiting}}<tr><td>{{.Awbno}}</td><td>{{.StatusCode}}</td><td align="right">{{.Minutes}}</td><td>{{.CompanyName}}</td><td>{{.SectionCode}}</td></tr>
+{{end}}</table>{{else}}<p>なし</p>{{end}}
+<h3>ロックファイルの強制削除</h3>
+{{if .LockRemovals}}<ul>
+{{range .LockRemovals}}<li>{{.Time.Format "01/02 15:04:05"}} {{.Lock}} {{.Lockfile}}</li>
+{{end}}</ul>{{else}}<p>なし</p>{{end}}
+</body></html>`
+
+var digestTimes [][2]int
+var digestSubject string
+var digestTopAwbs int
+var digestRecipients []string
+var digestSectionRecipients map[string][]string
+var digestText *texttemplate.Template
+var digestHtml *htmltemplate.Template
+var smtpHost string
+var smtpPort string
+var smtpUser string
+var smtpPassword string
+var smtpFrom string
+
+func splitAddresses(v string) []string {
+	result := make([]string, 0, 4)
+	for _, addr := range strings.Split(v, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			result = append(result, addr)
+		}
+	}
+	return result
+}
+
+// DigestTimes=日報を送る時刻(HH:MM)をカンマ区切りで指定する。未設定なら送らない
+// DigestRecipients=全部署分の宛先、DigestRecipients.<section_code>=その部署分の宛先
+// DigestTextTemplate,DigestHtmlTemplate=テンプレートのファイル。未設定なら組み込みのものを使う
+// SmtpHost,SmtpPort(既定25),SmtpUser,SmtpPassword,SmtpFrom=送信に使うSMTPサーバー。SmtpUserが空なら認証しない
+func loadDigestSettings(settings map[string]string) error {
+	digestTimes = make([][2]int, 0, 2)
+	for _, v := range strings.Split(settings["DigestTimes"], ",") {
+		if v = strings.TrimSpace(v); v == "" {
+			continue
+		}
+		t, err := time.Parse("15:04", v)
+		if err != nil {
+			return errors.New("DigestTimesが不正です:" + v)
+		}
+		digestTimes = append(digestTimes, [2]int{t.Hour(), t.Minute()})
+	}
+	digestSubject = settings["DigestSubject"]
+	if digestSubject == "" {
+		digestSubject = "STSチェッカー 日報"
+	}
+	digestTopAwbs = 10
+	if v := settings["DigestTopAwbs"]; v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return errors.New("DigestTopAwbsが不正です:" + v)
+		}
+		digestTopAwbs = n
+	}
+	digestRecipients = splitAddresses(settings["DigestRecipients"])
+	digestSectionRecipients = make(map[string][]string)
+	for k, v := range settings {
+		if strings.HasPrefix(k, digestSectionPrefix) && len(k) > len(digestSectionPrefix) {
+			if addrs := splitAddresses(v); len(addrs) > 0 {
+				digestSectionRecipients[strings.TrimPrefix(k, digestSectionPrefix)] = addrs
+			}
+		}
+	}
+
+	text, html := digestTextTemplate, digestHtmlTemplate
+	if path := settings["DigestTextTemplate"]; path != "" {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		text = string(b)
+	}
+	if path := settings["DigestHtmlTemplate"]; path != "" {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		html = string(b)
+	}
+	var err error
+	if digestText, err = texttemplate.New("digest.txt").Parse(text); err != nil {
+		return errors.New("日報のテンプレートが不正です:" + err.Error())
+	}
+	if digestHtml, err = htmltemplate.New("digest.html").Parse(html); err != nil {
+		return errors.New("日報のテンプレートが不正です:" + err.Error())
+	}
+
+	smtpHost = settings["SmtpHost"]
+	smtpPort = settings["SmtpPort"]
+	if smtpPort == "" {
+		smtpPort = "25"
+	}
+	smtpUser = settings["SmtpUser"]
+	smtpPassword = settings["SmtpPassword"]
+	smtpFrom = settings["SmtpFrom"]
+	if len(digestTimes) > 0 {
+		if smtpHost == "" {
+			return errors.New("SmtpHostが設定されていません")
+		}
+		if smtpFrom == "" {
+			return errors.New("SmtpFromが設定されていません")
+		}
+		if len(digestRecipients) < 1 && len(digestSectionRecipients) < 1 {
+			return errors.New("DigestRecipientsが設定されていません")
+		}
+	}
+	return nil
+}
+
+// nowより後で最も近い送信時刻
+func nextDigestTime(now time.Time) time.Time {
+	var next time.Time
+	for _, hm := range digestTimes {
+		t := time.Date(now.Year(), now.Month(), now.Day(), hm[0], hm[1], 0, 0, now.Location())
+		if !t.After(now) {
+			t = t.AddDate(0, 0, 1)
+		}
+		if next.IsZero() || t.Before(next) {
+			next = t
+		}
+	}
+	return next
+}
+
+// 送信時刻ごとに前回の送信からの分をまとめて送る
+func runDigests(met *metricsCollector) {
+	if len(digestTimes) < 1 {
+		return
+	}
+	last := time.Now()
+	for {
+		next := nextDigestTime(time.Now())
+		time.Sleep(time.Until(next))
+		runIngest("digest", func() error {
+			return sendDigests(met, last, next)
+		})
+		last = next
+	}
+}
+
+// 部署ごとの日報も送る。送れなかった宛先があってもほかの宛先には送る
+func sendDigests(met *metricsCollector, from, to time.Time) error {
+	msgs := make([]string, 0)
+	if len(digestRecipients) > 0 {
+		if err := sendDigest(buildDigest(met, "", from, to), digestRecipients); err != nil {
+			msgs = append(msgs, err.Error())
+		}
+	}
+	sections := make([]string, 0, len(digestSectionRecipients))
+	for section := range digestSectionRecipients {
+		sections = append(sections, section)
+	}
+	sort.Strings(sections)
+	for _, section := range sections {
+		if err := sendDigest(buildDigest(met, section, from, to), digestSectionRecipients[section]); err != nil {
+			msgs = append(msgs, section+":"+err.Error())
+		}
+	}
+	if len(msgs) > 0 {
+		return errors.New("日報を送信できませんでした " + strings.Join(msgs, " "))
+	}
+	log.Printf("日報を送信しました:%s - %s", from.Format("01/02 15:04"), to.Format("01/02 15:04"))
+	return nil
+}
+
+// AWBごとに現在のステータスになった時刻。アラートの追跡にまだないAWBは格納先の履歴から求める
+func waitingSince(snap *Snapshot, now time.Time) map[string]time.Time {
+	since := alerts.statusSince()
+	missing := make([]string, 0, 10)
+	for awb, status := range snap.Awbs {
+		if _, ok := since[awb]; !ok && !isTerminalStatus(status.StatusCode) {
+			missing = append(missing, awb)
+		}
+	}
+	if len(missing) < 1 || stsStore == nil {
+		return since
+	}
+	sort.Strings(missing)
+	carried, histories, err := historiesWithCarry(stsStore, missing, now.UnixMilli()-carryForwardWindow, now.UnixMilli())
+	if err != nil {
+		log.Printf("待ち時間を格納先から取得できません:%s", err)
+		return since
+	}
+	for _, awb := range missing {
+		if t := trackFromHistory(carried[awb], histories[awb], now); t != nil && t.status == snap.Awbs[awb].StatusCode {
+			since[awb] = t.since
+		}
+	}
+	return since
+}
+
+// 件数と待ち時間は現在のスナップショット、所要時間は当日(営業日)の集計から作る
+func buildDigest(met *metricsCollector, section string, from, to time.Time) digestData {
+	snap := currentSnapshot()
+	now := time.Now()
+	since := waitingSince(snap, now)
+	counts := make(map[string]int)
+	data := digestData{Title: digestSubject, Section: section, From: from, To: to, Waiting: make([]digestWaiting, 0, len(snap.Awbs))}
+	for awb, status := range snap.Awbs {
+		if section != "" && status.SectionCode != section {
+			continue
+		}
+		data.Total++
+		counts[status.StatusCode]++
+		//終了したステータスのAWBは待ちとして扱わない
+		if t, ok := since[awb]; ok && !isTerminalStatus(status.StatusCode) {
+			data.Waiting = append(data.Waiting, digestWaiting{
+				Awbno:       awb,
+				StatusCode:  status.StatusCode,
+				SectionCode: status.SectionCode,
+				CompanyName: status.CompanyName,
+				Since:       t,
+				Minutes:     int(now.Sub(t).Minutes()),
+			})
+		}
+	}
+	data.Statuses = make([]digestCount, 0, len(counts))
+	for code, n := range counts {
+		data.Statuses = append(data.Statuses, digestCount{StatusCode: code, Label: statusDef(code).Label, Count: n})
+	}
+	sort.SliceStable(data.Statuses, func(i, j int) bool { return statusBefore(data.Statuses[i].StatusCode, data.Statuses[j].StatusCode) })
+	sort.SliceStable(data.Waiting, func(i, j int) bool {
+		if !data.Waiting[i].Since.Equal(data.Waiting[j].Since) {
+			return data.Waiting[i].Since.Before(data.Waiting[j].Since)
+		}
+		return data.Waiting[i].Awbno < data.Waiting[j].Awbno
+	})
+	if len(data.Waiting) > digestTopAwbs {
+		data.Waiting = data.Waiting[:digestTopAwbs]
+	}
+	m := met.snapshot()
+	data.Day, data.Stages = m.Day, m.Stages
+	data.LockRemovals = lockRemovalsBetween(from, to)
+	return data
+}
+
+func renderDigest(data digestData) (text, html []byte, err error) {
+	var tb, hb bytes.Buffer
+	if err := digestText.Execute(&tb, data); err != nil {
+		return nil, nil, err
+	}
+	if err := digestHtml.Execute(&hb, data); err != nil {
+		return nil, nil, err
+	}
+	return tb.Bytes(), hb.Bytes(), nil
+}
+
+func sendDigest(data digestData, to []string) error {
+	text, html, err := renderDigest(data)
+	if err != nil {
+		return err
+	}
+	subject := data.Title
+	if data.Section != "" {
+		subject += " " + data.Section
+	}
+	var auth smtp.Auth
+	if smtpUser != "" {
+		auth = smtp.PlainAuth("", smtpUser, smtpPassword, smtpHost)
+	}
+	return smtp.SendMail(smtpHost+":"+smtpPort, auth, smtpFrom, to, digestMail(smtpFrom, to, subject, text, html))
+}
+
+// テキストとHTMLのmultipart/alternative。本文はbase64で送る
+func digestMail(from string, to []string, subject string, text, html []byte) []byte {
+	boundary := fmt.Sprintf("stschecker-%d", time.Now().UnixNano())
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.BEncoding.Encode("UTF-8", subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&b, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&b, "Content-Type: multipart/alternative; boundary=\"%s\"\r\n\r\n", boundary)
+	for _, part := range []struct {
+		contentType string
+		body        []byte
+	}{{"text/plain", text}, {"text/html", html}} {
+		fmt.Fprintf(&b, "--%s\r\n", boundary)
+		fmt.Fprintf(&b, "Content-Type: %s; charset=UTF-8\r\n", part.contentType)
+		fmt.Fprintf(&b, "Content-Transfer-Encoding: base64\r\n\r\n")
+		encoded := base64.StdEncoding.EncodeToString(part.body)
+		for len(encoded) > 76 {
+			b.WriteString(encoded[:76] + "\r\n")
+			encoded = encoded[76:]
+		}
+		b.WriteString(encoded + "\r\n")
+	}
+	fmt.Fprintf(&b, "--%s--\r\n", boundary)
+	return b.Bytes()
+}
+
+// 次に送る日報の内容を確認する。section=部署、format=text|html(既定html)
+func digestPreviewApi(c echo.Context, met *metricsCollector) error {
+	now := time.Now()
+	data := buildDigest(met, c.QueryParam("section"), businessDayStart(now), now)
+	text, html, err := renderDigest(data)
+	if err != nil {
+		log.Printf("%s", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponce{Error: err.Error()})
+	}
+	if c.QueryParam("format") == "text" {
+		return c.Blob(http.StatusOK, "text/plain; charset=utf-8", text)
+	}
+	return c.HTMLBlob(http.StatusOK, html)
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDigestWaitingFromStore(t *testing.T) {
+	if err := loadDigestSettings(map[string]string{}); err != nil {
+		t.Fatal(err)
+	}
+	prevStore, prevAlerts := stsStore, alerts
+	defer func() {
+		stsStore, alerts = prevStore, prevAlerts
+		swapSnapshot(map[string]AwbStatus{})
+	}()
+	s := newMemStore()
+	stsStore = s
+	//再起動直後でアラートの追跡がまだない
+	alerts = &alertEngine{tracks: make(map[string]*awbTrack), active: make(map[string]*Alert)}
+	now := time.Now()
+	s.Append([]StsDoc{
+		{Awbno: "1", StatusCode: "40", UpdateTime: now.Add(-3 * time.Hour).UnixMilli(), Event: eventChanged},
+		{Awbno: "1", StatusCode: "50", UpdateTime: now.Add(-90 * time.Minute).UnixMilli(), Event: eventChanged},
+		{Awbno: "2", StatusCode: "50", UpdateTime: now.Add(-30 * time.Minute).UnixMilli(), Event: eventChanged},
+	})
+	swapSnapshot(map[string]AwbStatus{
+		"1": {Awbno: "1", StatusCode: "50", SectionCode: "S1"},
+		"2": {Awbno: "2", StatusCode: "50", SectionCode: "S1"},
+		//格納先に記録がない
+		"3": {Awbno: "3", StatusCode: "50", SectionCode: "S1"},
+		"4": {Awbno: "4", StatusCode: "50", SectionCode: "S2"},
+	})
+	met := &metricsCollector{past: map[string]Metrics{}, stages: emptyStages()}
+	d := buildDigest(met, "S1", now.Add(-time.Hour), now)
+	if d.Total != 3 || len(d.Waiting) != 2 {
+		t.Fatalf("日報が違います:%+v", d)
+	}
+	if d.Waiting[0].Awbno != "1" || d.Waiting[0].Minutes != 90 || d.Waiting[1].Awbno != "2" || d.Waiting[1].Minutes != 30 {
+		t.Fatalf("待ち時間が違います:%+v", d.Waiting)
+	}
+}
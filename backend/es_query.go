@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// 検索条件はjson.Marshalで組み立て、入力値を文字列として連結しない
+type esQuery map[string]interface{}
+
+type esSearchBody struct {
+	Size        *int               `json:"size,omitempty"`
+	Query       esQuery            `json:"query,omitempty"`
+	Sort        []esQuery          `json:"sort,omitempty"`
+	SearchAfter []json.RawMessage  `json:"search_after,omitempty"`
+	Aggs        map[string]esQuery `json:"aggs,omitempty"`
+}
+
+// msearchの検索ごとのヘッダー行
+type esMsearchHeader struct {
+	Index             []string `json:"index"`
+	IgnoreUnavailable bool     `json:"ignore_unavailable"`
+	AllowNoIndices    bool     `json:"allow_no_indices"`
+}
+
+func esTerm(field, value string) esQuery {
+	return esQuery{"term": esQuery{field: esQuery{"value": value}}}
+}
+
+func esTerms(field string, values []string) esQuery {
+	return esQuery{"terms": esQuery{field: values}}
+}
+
+// from <= field < to。inclusiveToがtrueの場合は from <= field <= to
+func esRange(field string, from, to int64, inclusiveTo bool) esQuery {
+	bounds := esQuery{"gte": from}
+	if inclusiveTo {
+		bounds["lte"] = to
+	} else {
+		bounds["lt"] = to
+	}
+	return esQuery{"range": esQuery{field: bounds}}
+}
+
+func esMust(queries ...esQuery) esQuery {
+	return esQuery{"bool": esQuery{"must": queries}}
+}
+
+func esSort(field, order string) []esQuery {
+	return []esQuery{{field: esQuery{"order": order}}}
+}
+
+// 履歴の並び順。search_afterで続きを取得できるように同じ時刻の記録はeventで並べる
+func esHistorySort() []esQuery {
+	return append(esSort("update_time", "asc"), esSort("event", "asc")...)
+}
+
+// AWBごとに最新の1件を返す集計
+func esLatestPerAwb(filter esQuery, size int) map[string]esQuery {
+	return map[string]esQuery{
+		"f": {
+			"filter": filter,
+			"aggs": map[string]esQuery{
+				"awbs": {
+					"terms": esQuery{"size": size, "field": "awb_no"},
+					"aggs": map[string]esQuery{
+						"latest": {"top_hits": esQuery{"size": 1, "sort": esSort("update_time", "desc")}},
+					},
+				},
+			},
+		},
+	}
+}
+
+// AWBごとに最新の1件を返す集計をcompositeでsize件ずつ返す。afterには前回のafter_keyを渡す
+func esLatestPerAwbPage(filter esQuery, size int, after json.RawMessage) map[string]esQuery {
+	composite := esQuery{
+		"size":    size,
+		"sources": []esQuery{{"awb": esQuery{"terms": esQuery{"field": "awb_no"}}}},
+	}
+	if len(after) > 0 {
+		composite["after"] = after
+	}
+	return map[string]esQuery{
+		"f": {
+			"filter": filter,
+			"aggs": map[string]esQuery{
+				"page": {
+					"composite": composite,
+					"aggs": map[string]esQuery{
+						"latest": {"top_hits": esQuery{"size": 1, "sort": esSort("update_time", "desc")}},
+					},
+				},
+			},
+		},
+	}
+}
+
+func (b esSearchBody) reader() (*strings.Reader, error) {
+	body, err := json.Marshal(b)
+	if err != nil {
+		return nil, err
+	}
+	return strings.NewReader(string(body)), nil
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/xuri/excelize/v2"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/japanese"
+	"golang.org/x/text/encoding/unicode"
+	"golang.org/x/text/transform"
+)
+
+// 取り込むファイルの形式。設定は取り込み元ごとのプレフィックスを付けて指定する
+// IGSの結果ファイルは行単位のテキストのためEncodingのみ使う
+// <prefix>Format=csv|tsv|fixed|xlsx
+// <prefix>Encoding=ShiftJIS|CP932|EUCJP|UTF8|UTF8BOM
+// <prefix>Delimiter=区切り文字(csvのみ。既定は",")
+// <prefix>Quoting=standard|lazy|none
+// <prefix>SkipCtrlZ=true|false 末尾の\x1a(Ctrl-Z)の行を読み飛ばす
+// <prefix>FixedWidths=各列のバイト数をカンマ区切り(fixedのみ)
+// <prefix>Sheet=シート名(xlsxのみ。既定は最初のシート)
+type feedFormat struct {
+	Format      string
+	Encoding    encoding.Encoding
+	Delimiter   rune
+	Quoting     string
+	SkipCtrlZ   bool
+	FixedWidths []int
+	Sheet       string
+}
+
+type recordReader interface {
+	Read() ([]string, error)
+}
+
+var stsFormat feedFormat
+var igsFormat feedFormat
+
+func loadFeedFormat(settings map[string]string, prefix string, defaultEncoding string) (feedFormat, error) {
+	ff := feedFormat{Format: "csv", Delimiter: ',', Quoting: "standard", SkipCtrlZ: true}
+	if v := strings.ToLower(settings[prefix+"Format"]); v != "" {
+		ff.Format = v
+	}
+	switch ff.Format {
+	case "csv":
+	case "tsv":
+		ff.Delimiter = '\t'
+	case "fixed":
+		for _, w := range strings.Split(settings[prefix+"FixedWidths"], ",") {
+			width, err := strconv.Atoi(strings.TrimSpace(w))
+			if err != nil || width < 1 {
+				return ff, errors.New(prefix + "FixedWidthsが不正です:" + settings[prefix+"FixedWidths"])
+			}
+			ff.FixedWidths = append(ff.FixedWidths, width)
+		}
+	case "xlsx":
+		ff.Sheet = settings[prefix+"Sheet"]
+	default:
+		return ff, errors.New(prefix + "Formatが不正です:" + ff.Format)
+	}
+
+	enc := settings[prefix+"Encoding"]
+	if enc == "" {
+		enc = defaultEncoding
+	}
+	switch strings.ToUpper(strings.NewReplacer("-", "", "_", "").Replace(enc)) {
+	case "SHIFTJIS", "SJIS", "CP932", "WINDOWS31J":
+		//x/textのShiftJISはWHATWGの定義でCP932の拡張文字を含む
+		ff.Encoding = japanese.ShiftJIS
+	case "EUCJP":
+		ff.Encoding = japanese.EUCJP
+	case "UTF8":
+		ff.Encoding = unicode.UTF8
+	case "UTF8BOM":
+		ff.Encoding = unicode.UTF8BOM
+	default:
+		return ff, errors.New(prefix + "Encodingが不正です:" + enc)
+	}
+
+	if d := settings[prefix+"Delimiter"]; d != "" {
+		if d == `\t` {
+			d = "\t"
+		}
+		r, size := utf8.DecodeRuneInString(d)
+		if size != len(d) {
+			return ff, errors.New(prefix + "Delimiterは1文字で指定してください:" + d)
+		}
+		ff.Delimiter = r
+	}
+	if q := strings.ToLower(settings[prefix+"Quoting"]); q != "" {
+		if q != "standard" && q != "lazy" && q != "none" {
+			return ff, errors.New(prefix + "Quotingが不正です:" + q)
+		}
+		ff.Quoting = q
+	}
+	ff.SkipCtrlZ = settings[prefix+"SkipCtrlZ"] != "false"
+	return ff, nil
+}
+
+// 文字コードを変換するReader。UTF-8の場合は先頭のBOMがあれば取り除く
+func (ff feedFormat) decode(r io.Reader) io.Reader {
+	if ff.Encoding == unicode.UTF8 {
+		return transform.NewReader(r, unicode.BOMOverride(unicode.UTF8.NewDecoder()))
+	}
+	return transform.NewReader(r, ff.Encoding.NewDecoder())
+}
+
+func (ff feedFormat) newReader(r io.Reader) (recordReader, error) {
+	var rr recordReader
+	switch ff.Format {
+	case "fixed":
+		rr = &fixedReader{sc: bufio.NewScanner(r), widths: ff.FixedWidths, dec: ff.Encoding.NewDecoder()}
+	case "xlsx":
+		ef, err := excelize.OpenReader(r)
+		if err != nil {
+			return nil, err
+		}
+		defer ef.Close()
+		sheet := ff.Sheet
+		if sheet == "" {
+			sheet = ef.GetSheetName(0)
+		}
+		rows, err := ef.GetRows(sheet)
+		if err != nil {
+			return nil, err
+		}
+		//右端の空のセルは省略されるため最大の列数に揃える
+		width := 0
+		for _, row := range rows {
+			if len(row) > width {
+				width = len(row)
+			}
+		}
+		for i := range rows {
+			for len(rows[i]) < width {
+				rows[i] = append(rows[i], "")
+			}
+		}
+		rr = &sliceReader{rows: rows}
+	default:
+		if ff.Quoting == "none" {
+			rr = &splitReader{sc: bufio.NewScanner(ff.decode(r)), sep: string(ff.Delimiter)}
+		} else {
+			cr := csv.NewReader(ff.decode(r))
+			cr.Comma = ff.Delimiter
+			cr.LazyQuotes = ff.Quoting == "lazy"
+			//末尾の\x1aの行は列数が異なる
+			cr.FieldsPerRecord = -1
+			rr = cr
+		}
+	}
+	if ff.SkipCtrlZ {
+		rr = &ctrlZSkipper{r: rr}
+	}
+	return rr, nil
+}
+
+// 末尾のCtrl-Z(\x1a)だけの行を読み飛ばす
+type ctrlZSkipper struct {
+	r recordReader
+}
+
+func (s *ctrlZSkipper) Read() ([]string, error) {
+	for {
+		record, err := s.r.Read()
+		if len(record) > 0 && strings.HasPrefix(record[0], "\x1a") {
+			continue
+		}
+		return record, err
+	}
+}
+
+// 引用符を解釈せずに区切り文字で分割する
+type splitReader struct {
+	sc  *bufio.Scanner
+	sep string
+}
+
+func (s *splitReader) Read() ([]string, error) {
+	if !s.sc.Scan() {
+		if err := s.sc.Err(); err != nil {
+			return nil, err
+		}
+		return nil, io.EOF
+	}
+	return strings.Split(strings.TrimRight(s.sc.Text(), "\r"), s.sep), nil
+}
+
+// 固定長レコード。列の幅は変換前のバイト数で数える
+type fixedReader struct {
+	sc     *bufio.Scanner
+	widths []int
+	dec    *encoding.Decoder
+}
+
+func (f *fixedReader) Read() ([]string, error) {
+	if !f.sc.Scan() {
+		if err := f.sc.Err(); err != nil {
+			return nil, err
+		}
+		return nil, io.EOF
+	}
+	line := bytes.TrimRight(f.sc.Bytes(), "\r")
+	if len(line) > 0 && line[0] == 0x1a {
+		return []string{"\x1a"}, nil
+	}
+	record := make([]string, 0, len(f.widths))
+	pos := 0
+	for _, w := range f.widths {
+		//行が短い場合は残りの列を空にする
+		if pos >= len(line) {
+			record = append(record, "")
+			continue
+		}
+		end := pos + w
+		if end > len(line) {
+			end = len(line)
+		}
+		field, err := f.dec.Bytes(line[pos:end])
+		if err != nil {
+			return nil, err
+		}
+		record = append(record, string(field))
+		pos = end
+	}
+	return record, nil
+}
+
+type sliceReader struct {
+	rows [][]string
+	pos  int
+}
+
+func (s *sliceReader) Read() ([]string, error) {
+	if s.pos >= len(s.rows) {
+		return nil, io.EOF
+	}
+	s.pos++
+	return s.rows[s.pos-1], nil
+}
+
+// ファイル全体を文字コードを変換して読み込む
+func readFeedFile(ff feedFormat, name string) ([]byte, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ioutil.ReadAll(ff.decode(f))
+}
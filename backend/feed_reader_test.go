@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"golang.org/x/text/encoding/japanese"
+)
+
+func readAllRecords(t *testing.T, r interface{ Read() ([]string, error) }) [][]string {
+	records := make([][]string, 0, 10)
+	for {
+		rec, err := r.Read()
+		if err == io.EOF {
+			return records
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, rec)
+	}
+}
+
+func TestFeedReaderCsv(t *testing.T) {
+	ff, err := loadFeedFormat(map[string]string{}, "STS", "ShiftJIS")
+	if err != nil {
+		t.Fatal(err)
+	}
+	//末尾のEOF文字(0x1a)は読み飛ばす
+	raw, _ := japanese.ShiftJIS.NewEncoder().Bytes([]byte("h0,h1\n\"会社,A\",x\n\x1a\n"))
+	r, err := ff.newReader(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	records := readAllRecords(t, r)
+	if len(records) != 2 || records[1][0] != "会社,A" || records[1][1] != "x" {
+		t.Fatalf("CSVの読み込みが違います:%q", records)
+	}
+
+	//UTF8はBOMを取り除く
+	ff, err = loadFeedFormat(map[string]string{}, "IGS", "UTF8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, _ = ff.newReader(bytes.NewReader([]byte("\xef\xbb\xbfa,b\n")))
+	if records := readAllRecords(t, r); len(records) != 1 || records[0][0] != "a" {
+		t.Fatalf("BOMの扱いが違います:%q", records)
+	}
+}
+
+func TestFeedReaderFixed(t *testing.T) {
+	ff, err := loadFeedFormat(map[string]string{"STSFormat": "fixed", "STSFixedWidths": "4,2"}, "STS", "ShiftJIS")
+	if err != nil {
+		t.Fatal(err)
+	}
+	//幅はShiftJISのバイト数。短い行は空の列で補う
+	raw, _ := japanese.ShiftJIS.NewEncoder().Bytes([]byte("会社AB\r\nX\r\n"))
+	r, _ := ff.newReader(bytes.NewReader(raw))
+	records := readAllRecords(t, r)
+	if len(records) != 2 || records[0][0] != "会社" || records[0][1] != "AB" || len(records[1]) != 2 || records[1][0] != "X" {
+		t.Fatalf("固定長の読み込みが違います:%q", records)
+	}
+
+	if _, err := loadFeedFormat(map[string]string{"STSFormat": "fixed"}, "STS", "ShiftJIS"); err == nil {
+		t.Fatal("幅の指定がない固定長を受け付けています")
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// 取り込み元の状態。downが1つでもあれば全体もdown
+const (
+	healthOK       = "ok"
+	healthDegraded = "degraded"
+	healthDown     = "down"
+)
+
+type SourceHealth struct {
+	Source              string     `json:"source"`
+	Label               string     `json:"label"`
+	State               string     `json:"state"`
+	Reason              string     `json:"reason"`
+	LastSuccessTime     *time.Time `json:"last_success_time"`
+	LastErrorTime       *time.Time `json:"last_error_time"`
+	LastError           string     `json:"last_error"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+}
+
+type HealthReport struct {
+	State     string         `json:"state"`
+	CheckedAt time.Time      `json:"checked_at"`
+	Sources   []SourceHealth `json:"sources"`
+}
+
+// Periodicの取り込み元は最後に成功してからの時間でも判定する
+type healthSource struct {
+	Name          string
+	Setting       string
+	Label         string
+	Periodic      bool
+	StaleDegraded time.Duration
+	StaleDown     time.Duration
+}
+
+var healthSources []healthSource
+var healthFailuresDown int
+var healthLivenessTimeout time.Duration
+var processStarted = time.Now()
+
+// HealthStaleDegraded,HealthStaleDown=最後に成功してから経過するとdegraded,downにする時間(既定7分,10分)
+// Health<取り込み元>StaleDegraded等で取り込み元ごとに変えられる
+// HealthFailuresDown=連続して失敗するとdownにする回数(既定5回)。1回でも失敗していればdegraded
+// HealthLivenessTimeout=1回の取り込みがこれより長く終わらない場合は/healthz/liveを失敗にする(既定10分)
+func loadHealthSettings(settings map[string]string) error {
+	staleDegraded, err := durationSetting(settings, "HealthStaleDegraded", 7*time.Minute)
+	if err != nil {
+		return err
+	}
+	staleDown, err := durationSetting(settings, "HealthStaleDown", 10*time.Minute)
+	if err != nil {
+		return err
+	}
+	storeLabel := "格納先(elasticsearch)"
+	if storeType != "" {
+		storeLabel = "格納先(" + storeType + ")"
+	}
+	healthSources = []healthSource{
+		{Name: "sts", Setting: "STS", Label: "STSファイル", Periodic: true},
+		{Name: "igs", Setting: "IGS", Label: "IGS結果", Periodic: true},
+		{Name: "sts75", Setting: "STS75", Label: "75リスト", Periodic: true},
+		{Name: "store", Setting: "Store", Label: storeLabel, Periodic: true},
+		{Name: "gateway", Setting: "Gateway", Label: "ゲートウェイHTML"},
+	}
+	for i := range healthSources {
+		src := &healthSources[i]
+		if src.StaleDegraded, err = durationSetting(settings, "Health"+src.Setting+"StaleDegraded", staleDegraded); err != nil {
+			return err
+		}
+		if src.StaleDown, err = durationSetting(settings, "Health"+src.Setting+"StaleDown", staleDown); err != nil {
+			return err
+		}
+	}
+	healthFailuresDown = 5
+	if settings["HealthFailuresDown"] != "" {
+		n, err := strconv.Atoi(settings["HealthFailuresDown"])
+		if err != nil || n < 1 {
+			return errors.New("HealthFailuresDownが不正です:" + settings["HealthFailuresDown"])
+		}
+		healthFailuresDown = n
+	}
+	if healthLivenessTimeout, err = durationSetting(settings, "HealthLivenessTimeout", 10*time.Minute); err != nil {
+		return err
+	}
+	return nil
+}
+
+func healthRank(state string) int {
+	switch state {
+	case healthDown:
+		return 2
+	case healthDegraded:
+		return 1
+	}
+	return 0
+}
+
+func sourceHealth(src healthSource, errs *SourceErrors, now time.Time) SourceHealth {
+	h := SourceHealth{Source: src.Name, Label: src.Label, State: healthOK}
+	if errs != nil {
+		h.LastSuccessTime = errs.LastSuccessTime
+		h.LastErrorTime = errs.LastErrorTime
+		h.LastError = errs.LastError
+		h.ConsecutiveFailures = errs.ConsecutiveFailures
+	}
+	if h.ConsecutiveFailures >= healthFailuresDown {
+		h.State, h.Reason = healthDown, strconv.Itoa(h.ConsecutiveFailures)+"回連続で失敗しています"
+	} else if h.ConsecutiveFailures > 0 {
+		h.State, h.Reason = healthDegraded, strconv.Itoa(h.ConsecutiveFailures)+"回連続で失敗しています"
+	}
+	if !src.Periodic {
+		return h
+	}
+	//一度も成功していない場合は起動してからの時間で判定する
+	since := processStarted
+	if h.LastSuccessTime != nil {
+		since = *h.LastSuccessTime
+	}
+	stale := now.Sub(since)
+	state, reason := healthOK, ""
+	if stale > src.StaleDown {
+		state, reason = healthDown, stale.Truncate(time.Second).String()+"成功していません"
+	} else if stale > src.StaleDegraded {
+		state, reason = healthDegraded, stale.Truncate(time.Second).String()+"成功していません"
+	}
+	if healthRank(state) > healthRank(h.State) {
+		h.State, h.Reason = state, reason
+	}
+	return h
+}
+
+func healthReport() HealthReport {
+	now := time.Now()
+	errs := make(map[string]SourceErrors)
+	for _, src := range ingestErrors.list() {
+		errs[src.Source] = src
+	}
+	report := HealthReport{State: healthOK, CheckedAt: now, Sources: make([]SourceHealth, 0, len(healthSources))}
+	for _, src := range healthSources {
+		var h SourceHealth
+		if e, ok := errs[src.Name]; ok {
+			h = sourceHealth(src, &e, now)
+		} else {
+			h = sourceHealth(src, nil, now)
+		}
+		if healthRank(h.State) > healthRank(report.State) {
+			report.State = h.State
+		}
+		report.Sources = append(report.Sources, h)
+	}
+	return report
+}
+
+func healthApi(c echo.Context) error {
+	return c.JSON(http.StatusOK, healthReport())
+}
+
+// プロセスの監視用。取り込みが止まったまま終わらない場合は再起動させる
+func livenessApi(c echo.Context) error {
+	if name, d := ingestErrors.longestRunning(); d > healthLivenessTimeout {
+		return c.JSON(http.StatusServiceUnavailable, ErrorResponce{Error: name + "の取り込みが" + d.Truncate(time.Second).String() + "終わっていません"})
+	}
+	return c.JSON(http.StatusOK, map[string]string{"status": healthOK})
+}
+
+// 最初のSTSファイルを読み込み、downの取り込み元がなければ受け付ける
+func readinessApi(c echo.Context) error {
+	report := healthReport()
+	if currentSnapshot().Version < 1 {
+		return c.JSON(http.StatusServiceUnavailable, ErrorResponce{Error: "STSファイルをまだ読み込んでいません"})
+	}
+	if report.State == healthDown {
+		return c.JSON(http.StatusServiceUnavailable, report)
+	}
+	return c.JSON(http.StatusOK, report)
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+type HistoryEntry struct {
+	StatusCode      string     `json:"status_code"`
+	EnteredAt       time.Time  `json:"entered_at"`
+	LeftAt          *time.Time `json:"left_at"`
+	DurationMinutes float64    `json:"duration"`
+	SectionCode     string     `json:"section_code"`
+	LastUserName    string     `json:"last_updated_user"`
+	LastUserId      string     `json:"last_updated_id"`
+	IgsStatus       string     `json:"igs_status"`
+}
+
+type HistoryResponce struct {
+	Awbno   string         `json:"awbno"`
+	History []HistoryEntry `json:"history"`
+}
+
+// 記録の並びをステータスが変わった時点ごとにまとめる
+// 現在のステータスはleft_atがnullで、durationはuntil(現在時刻か検索期間の終わり)までの分数
+// 削除の記録があった場合はその時点でステータスを終える
+func collapseHistory(docs []StsDoc, until int64) []HistoryEntry {
+	muniteUnit := float64(60 * 1000)
+	result := make([]HistoryEntry, 0, 10)
+	var start, last *StsDoc
+	closeEntry := func(end int64) {
+		left := time.UnixMilli(end)
+		result = append(result, HistoryEntry{
+			StatusCode:      start.StatusCode,
+			EnteredAt:       time.UnixMilli(start.UpdateTime),
+			LeftAt:          &left,
+			DurationMinutes: float64(end-start.UpdateTime) / muniteUnit,
+			SectionCode:     start.SectionCode,
+			LastUserName:    start.LastUserName,
+			LastUserId:      start.LastUserId,
+			IgsStatus:       last.IgsStatus,
+		})
+	}
+	for i := range docs {
+		doc := &docs[i]
+		if isRemoved(*doc) {
+			if start != nil {
+				closeEntry(doc.UpdateTime)
+			}
+			start, last = nil, nil
+			continue
+		}
+		if start != nil && doc.StatusCode != start.StatusCode {
+			closeEntry(doc.UpdateTime)
+			start = nil
+		}
+		if start == nil {
+			start = doc
+		}
+		last = doc
+	}
+	if start == nil {
+		return result
+	}
+	if until < last.UpdateTime {
+		until = last.UpdateTime
+	}
+	result = append(result, HistoryEntry{
+		StatusCode:      start.StatusCode,
+		EnteredAt:       time.UnixMilli(start.UpdateTime),
+		LeftAt:          nil,
+		DurationMinutes: float64(until-start.UpdateTime) / muniteUnit,
+		SectionCode:     start.SectionCode,
+		LastUserName:    start.LastUserName,
+		LastUserId:      start.LastUserId,
+		IgsStatus:       last.IgsStatus,
+	})
+	return result
+}
+
+// from,to(UnixTime millsec)を省略した場合は直近24時間
+func historyApi(c echo.Context, s StatusStore) error {
+	awbno, err := normalizeAwbKey(c.Param("awbno"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorResponce{Error: err.Error()})
+	}
+	to_i64 := time.Now().UnixMilli()
+	from_i64 := to_i64 - 24*60*60*1000
+	if c.QueryParam("to") != "" {
+		if to_i64, err = strconv.ParseInt(c.QueryParam("to"), 10, 64); err != nil {
+			return c.JSON(http.StatusBadRequest, nil)
+		}
+	}
+	if c.QueryParam("from") != "" {
+		if from_i64, err = strconv.ParseInt(c.QueryParam("from"), 10, 64); err != nil {
+			return c.JSON(http.StatusBadRequest, nil)
+		}
+	}
+	//fromより前から続いているステータスは入った時刻から返す
+	carried, docs, err := historyWithCarry(s, awbno, from_i64, to_i64)
+	if err != nil {
+		log.Printf("%s", err)
+		return c.JSON(http.StatusInternalServerError, nil)
+	}
+	if carried != nil {
+		docs = append([]StsDoc{*carried}, docs...)
+	}
+	until := time.Now().UnixMilli()
+	if to_i64 < until {
+		until = to_i64
+	}
+	return c.JSON(http.StatusOK, HistoryResponce{Awbno: awbno, History: collapseHistory(docs, until)})
+}
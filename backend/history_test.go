@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestCollapseHistory(t *testing.T) {
+	t0 := testBaseTime().UnixMilli()
+	min := int64(60 * 1000)
+	docs := []StsDoc{
+		{Awbno: "A", StatusCode: "50", UpdateTime: t0, Event: eventChanged},
+		{Awbno: "A", StatusCode: "50", UpdateTime: t0 + 10*min, Event: eventHeartbeat, IgsStatus: "-1"},
+		{Awbno: "A", StatusCode: "70", UpdateTime: t0 + 20*min, Event: eventChanged},
+		{Awbno: "A", StatusCode: "70", UpdateTime: t0 + 50*min, Event: eventRemoved},
+		{Awbno: "A", StatusCode: "72", UpdateTime: t0 + 60*min, Event: eventChanged},
+	}
+	h := collapseHistory(docs, t0+90*min)
+	if len(h) != 3 {
+		t.Fatalf("件数が違います:%+v", h)
+	}
+	if h[0].StatusCode != "50" || h[0].DurationMinutes != 20 || h[0].IgsStatus != "-1" {
+		t.Fatalf("1件目が違います:%+v", h[0])
+	}
+	//削除の記録でステータスを終える
+	if h[1].StatusCode != "70" || h[1].LeftAt == nil || h[1].LeftAt.UnixMilli() != t0+50*min || h[1].DurationMinutes != 30 {
+		t.Fatalf("2件目が違います:%+v", h[1])
+	}
+	if h[2].StatusCode != "72" || h[2].LeftAt != nil || h[2].DurationMinutes != 30 {
+		t.Fatalf("現在のステータスが違います:%+v", h[2])
+	}
+	if h := collapseHistory(nil, t0); len(h) != 0 {
+		t.Fatalf("記録がない場合は空にします:%+v", h)
+	}
+}
+
+func TestHistoryApi(t *testing.T) {
+	s := newMemStore()
+	t0 := testBaseTime()
+	s.Append([]StsDoc{
+		{Awbno: "11111111-2", StatusCode: "50", UpdateTime: t0.Add(-30 * time.Minute).UnixMilli(), Event: eventChanged},
+		{Awbno: "11111111-2", StatusCode: "70", UpdateTime: t0.Add(25 * time.Minute).UnixMilli(), Event: eventChanged},
+	})
+	c, rec := newTestContext(http.MethodGet, "/api/awb/11111111-2/history?from="+ms(t0)+"&to="+ms(t0.Add(time.Hour)))
+	c.SetParamNames("awbno")
+	c.SetParamValues("11111111-2")
+	if err := historyApi(c, s); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != http.StatusOK {
+		t.Fatalf("ステータスコードが違います:%d", rec.Code)
+	}
+	var res HistoryResponce
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Awbno != "11111111-2" || len(res.History) != 2 {
+		t.Fatalf("履歴が違います:%s", rec.Body)
+	}
+	//fromより前から続いていたステータスは入った時刻を返す
+	first := res.History[0]
+	if first.StatusCode != "50" || !first.EnteredAt.Equal(t0.Add(-30*time.Minute)) || first.LeftAt == nil || !first.LeftAt.Equal(t0.Add(25*time.Minute)) {
+		t.Fatalf("引き継いだステータスが違います:%+v", first)
+	}
+	if res.History[1].StatusCode != "70" || res.History[1].LeftAt != nil || res.History[1].DurationMinutes != 35 {
+		t.Fatalf("現在のステータスが違います:%+v", res.History[1])
+	}
+
+	c, rec = newTestContext(http.MethodGet, "/api/awb/x/history")
+	c.SetParamNames("awbno")
+	c.SetParamValues("1111-1111-1")
+	historyApi(c, s)
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("不正なAWB番号のステータスコードが違います:%d", rec.Code)
+	}
+}
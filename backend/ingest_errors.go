@@ -0,0 +1,163 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+const maxRecentIngestErrors = 50
+
+type IngestError struct {
+	Source  string    `json:"source"`
+	Time    time.Time `json:"time"`
+	Message string    `json:"message"`
+}
+
+// 取り込み元(sts,sts75,igs,store,gateway)ごとのエラー状況
+type SourceErrors struct {
+	Source              string        `json:"source"`
+	LastError           string        `json:"last_error"`
+	LastErrorTime       *time.Time    `json:"last_error_time"`
+	LastSuccessTime     *time.Time    `json:"last_success_time"`
+	ConsecutiveFailures int           `json:"consecutive_failures"`
+	NextRetry           *time.Time    `json:"next_retry"`
+	Recent              []IngestError `json:"recent"`
+}
+
+type IngestErrorsResponce struct {
+	Sources []SourceErrors `json:"sources"`
+}
+
+type ingestErrorLog struct {
+	mu      sync.Mutex
+	sources map[string]*SourceErrors
+	//実行中の取り込みと開始時刻
+	running map[string]time.Time
+}
+
+var ingestErrors = &ingestErrorLog{sources: make(map[string]*SourceErrors), running: make(map[string]time.Time)}
+
+// 呼び出し側でロックを取得しておくこと
+func (l *ingestErrorLog) source(name string) *SourceErrors {
+	s, ok := l.sources[name]
+	if !ok {
+		s = &SourceErrors{Source: name, Recent: make([]IngestError, 0, maxRecentIngestErrors)}
+		l.sources[name] = s
+	}
+	return s
+}
+
+// 失敗を記録し、次に再試行するまでの待ち時間を返す
+func (l *ingestErrorLog) record(name string, err error) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	s := l.source(name)
+	now := time.Now()
+	s.LastError = err.Error()
+	s.LastErrorTime = &now
+	s.ConsecutiveFailures++
+	wait := retryBackoff(s.ConsecutiveFailures)
+	next := now.Add(wait)
+	s.NextRetry = &next
+	if len(s.Recent) >= maxRecentIngestErrors {
+		s.Recent = s.Recent[1:]
+	}
+	s.Recent = append(s.Recent, IngestError{Source: name, Time: now, Message: err.Error()})
+	log.Printf("取り込みに失敗しました(%s %d回連続)。%s後に再試行します:%s", name, s.ConsecutiveFailures, wait, err)
+	return wait
+}
+
+func (l *ingestErrorLog) succeed(name string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	s := l.source(name)
+	now := time.Now()
+	s.LastSuccessTime = &now
+	s.ConsecutiveFailures = 0
+	s.NextRetry = nil
+}
+
+func (l *ingestErrorLog) start(name string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.running[name] = time.Now()
+}
+
+func (l *ingestErrorLog) finish(name string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.running, name)
+}
+
+// 実行中の取り込みのうち最も長く続いているもの
+func (l *ingestErrorLog) longestRunning() (string, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	name, longest := "", time.Duration(0)
+	for n, started := range l.running {
+		if d := time.Since(started); d > longest {
+			name, longest = n, d
+		}
+	}
+	return name, longest
+}
+
+func (l *ingestErrorLog) list() []SourceErrors {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	result := make([]SourceErrors, 0, len(l.sources))
+	for _, s := range l.sources {
+		c := *s
+		c.Recent = append([]IngestError(nil), s.Recent...)
+		result = append(result, c)
+	}
+	sort.SliceStable(result, func(i, j int) bool { return result[i].Source < result[j].Source })
+	return result
+}
+
+// 5秒から倍々で最大5分
+func retryBackoff(failures int) time.Duration {
+	wait := 5 * time.Second
+	for i := 1; i < failures && wait < 5*time.Minute; i++ {
+		wait *= 2
+	}
+	if wait > 5*time.Minute {
+		wait = 5 * time.Minute
+	}
+	return wait
+}
+
+// 取り込み処理を実行し、結果を記録する。panicした場合もエラーとして扱う
+// 失敗した場合は再試行までの待ち時間を返す
+func runIngest(name string, fn func() error) (wait time.Duration, failed bool) {
+	start := time.Now()
+	ingestErrors.start(name)
+	defer ingestErrors.finish(name)
+	err := func() (err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				err = errors.New(fmt.Sprint("panic: ", r))
+			}
+		}()
+		return fn()
+	}()
+	promIngestDuration.WithLabelValues(name).Observe(time.Since(start).Seconds())
+	if err != nil {
+		promIngestTotal.WithLabelValues(name, "failure").Inc()
+		return ingestErrors.record(name, err), true
+	}
+	promIngestTotal.WithLabelValues(name, "success").Inc()
+	ingestErrors.succeed(name)
+	return 0, false
+}
+
+func ingestErrorsApi(c echo.Context) error {
+	return c.JSON(http.StatusOK, IngestErrorsResponce{Sources: ingestErrors.list()})
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// 強制削除したロックファイルの記録。日報に載せる
+type lockRemoval struct {
+	Time     time.Time
+	Lock     string
+	Lockfile string
+}
+
+const maxLockRemovals = 100
+
+var lockRemovalsMu sync.Mutex
+var lockRemovals = make([]lockRemoval, 0, maxLockRemovals)
+
+func recordLockRemoval(name, lockfile string) {
+	lockRemovalsMu.Lock()
+	defer lockRemovalsMu.Unlock()
+	if len(lockRemovals) >= maxLockRemovals {
+		lockRemovals = lockRemovals[1:]
+	}
+	lockRemovals = append(lockRemovals, lockRemoval{Time: time.Now(), Lock: name, Lockfile: lockfile})
+}
+
+// from <= 削除した時刻 < to の記録
+func lockRemovalsBetween(from, to time.Time) []lockRemoval {
+	lockRemovalsMu.Lock()
+	defer lockRemovalsMu.Unlock()
+	result := make([]lockRemoval, 0)
+	for _, r := range lockRemovals {
+		if !r.Time.Before(from) && r.Time.Before(to) {
+			result = append(result, r)
+		}
+	}
+	return result
+}
+
+// ロックの解除を待つ回数(1秒ごと)
+var lockRetries = 30
+
+// 元ファイルへのハードリンクをロックファイルとして作成する。作成できるまで1秒ごとに再試行し、
+// 30秒待っても解除されない場合はロックファイルを強制削除して1回だけ作成し直す
+// それでも作成できない場合(元ファイルがないなど)はエラーを返す
+func acquireLock(name, originfile, lockfile string) error {
+	start := time.Now()
+	defer func() {
+		promLockWait.WithLabelValues(name).Observe(time.Since(start).Seconds())
+	}()
+	for cntr := 0; cntr < lockRetries; cntr++ {
+		if err := os.Link(originfile, lockfile); err == nil {
+			return nil
+		}
+		time.Sleep(time.Second * 1)
+	}
+	log.Println("30秒待ちましたがロックが解除されません。ロックファイルを強制削除します" + ":" + lockfile)
+	promLockForced.WithLabelValues(name).Inc()
+	recordLockRemoval(name, lockfile)
+	os.Remove(lockfile)
+	return os.Link(originfile, lockfile)
+}
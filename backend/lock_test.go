@@ -0,0 +1,42 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAcquireLock(t *testing.T) {
+	lockRetries = 1
+	defer func() { lockRetries = 30 }()
+	dir := t.TempDir()
+	origin := filepath.Join(dir, "origin")
+	lock := filepath.Join(dir, "lock")
+	if err := ioutil.WriteFile(origin, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if err := acquireLock("test", origin, lock); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(lockRemovalsBetween(start, time.Now().Add(time.Second))); n != 0 {
+		t.Fatalf("強制削除の記録が違います:%d件", n)
+	}
+
+	//解除されないロックは強制削除して作成し直す
+	if err := acquireLock("test", origin, lock); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(lockRemovalsBetween(start, time.Now().Add(time.Second))); n != 1 {
+		t.Fatalf("強制削除の記録が違います:%d件", n)
+	}
+
+	//元ファイルがない場合は再試行を続けずにエラーを返す
+	if err := acquireLock("test", filepath.Join(dir, "none"), filepath.Join(dir, "lock2")); err == nil {
+		t.Fatal("エラーになりません")
+	}
+	if n := len(lockRemovalsBetween(start, time.Now().Add(time.Second))); n != 2 {
+		t.Fatalf("強制削除の記録が違います:%d件", n)
+	}
+}
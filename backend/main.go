@@ -1,9 +1,6 @@
 package main
 
 import (
-	"context"
-	"encoding/csv"
-	"encoding/json"
 	"errors"
 	"io"
 	"io/fs"
@@ -16,18 +13,14 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
-	"github.com/elastic/go-elasticsearch/v7"
-	"github.com/elastic/go-elasticsearch/v7/esapi"
 	"github.com/labstack/echo"
 	"github.com/labstack/echo/middleware"
 	"github.com/xuri/excelize/v2"
-	"golang.org/x/text/encoding/japanese"
-	"golang.org/x/text/transform"
 )
 
-var es_sts_idx string
 var lockFolderPath string
 var stsFilePath string
 var sts75FilePath string
@@ -58,6 +51,10 @@ type StatusResponse struct {
 	Status []Status `json:"status"`
 }
 
+type ErrorResponce struct {
+	Error string `json:"error"`
+}
+
 type Status struct {
 	Index             int       `json:"index"`
 	Awbno             string    `json:"awbno"`
@@ -83,37 +80,67 @@ type AwbStatus struct {
 	CompanyName  string    `json:"company_name"`
 	LastUserName string    `json:"last_updated_user"`
 	LastUserId   string    `json:"last_updated_id"`
+	IgsStatus    string    `json:"igs_status"`
 }
 
 type AWBResponce struct {
 	TtlAwbs int      `json:"ttl"`
 	Awbno   []string `json:"awbnos"`
+	Version int64    `json:"version"`
 }
 
+// Resultがnilの場合はIGSファイルの読み込み
 type STSResult struct {
 	Result []AwbStatus
-	Error  error
 }
 
 type UserResponce struct {
-	User []string `json:"users"`
+	User    []string `json:"users"`
+	Version int64    `json:"version"`
 }
 
 type StslistResponce struct {
-	StatusCode []string `json:"statuscodes"`
+	StatusCode []string    `json:"statuscodes"`
+	Catalog    []StatusDef `json:"catalog"`
+	Version    int64       `json:"version"`
 }
 
+// sakuttl等は画面の互換のため。区間ごとの集計はstages
 type Metrics struct {
-	SakuAccumMins float64 `json:"sakuttl"`
-	SakuAccumCnts int64   `json:"sakucnt"`
-	ShinAccumMins float64 `json:"shinttl"`
-	ShinAccumCnts int64   `json:"shincnt"`
+	Day           string         `json:"day"`
+	SakuAccumMins float64        `json:"sakuttl"`
+	SakuAccumCnts int64          `json:"sakucnt"`
+	ShinAccumMins float64        `json:"shinttl"`
+	ShinAccumCnts int64          `json:"shincnt"`
+	Stages        []StageMetrics `json:"stages"`
 }
 
 type DeadorAlive struct {
-	LastStsUpdated float64 `json:"laststsupdated"`
-	LastIgsUpdated float64 `json:"lastigsupdated"`
-	DeadorAlive    string  `json:"status"`
+	LastStsUpdated float64        `json:"laststsupdated"`
+	LastIgsUpdated float64        `json:"lastigsupdated"`
+	DeadorAlive    string         `json:"status"`
+	Errors         []SourceErrors `json:"errors"`
+	Health         HealthReport   `json:"health"`
+}
+
+// 取り込みのゴルーチンとAPIの両方から参照するため、更新時刻はロックを取得して読み書きする
+var deadOrAliveMu sync.Mutex
+
+// stsがfalseの場合はIGSの更新時刻
+func (d *DeadorAlive) setUpdated(sts bool, now time.Time) {
+	deadOrAliveMu.Lock()
+	defer deadOrAliveMu.Unlock()
+	if sts {
+		d.LastStsUpdated = float64(now.UnixMilli())
+	} else {
+		d.LastIgsUpdated = float64(now.UnixMilli())
+	}
+}
+
+func (d *DeadorAlive) lastUpdated() (sts, igs float64) {
+	deadOrAliveMu.Lock()
+	defer deadOrAliveMu.Unlock()
+	return d.LastStsUpdated, d.LastIgsUpdated
 }
 
 func main() {
@@ -121,13 +148,18 @@ func main() {
 		MaxIdleConns:        500,
 		MaxIdleConnsPerHost: 100,
 	}
+	if len(os.Args) > 2 && os.Args[1] == "import" {
+		if err := runImport(os.Args[2:]); err != nil {
+			log.Fatalf("%v", err)
+		}
+		return
+	}
 	if err := Init(); err != nil {
 		log.Fatalf("%v", err)
 	}
-	STS := make(map[string]AwbStatus)
-	SakuBlackList := make(map[string]bool)
-	ShinBlackList := make(map[string]bool)
-	Metrics := Metrics{SakuAccumMins: 0, SakuAccumCnts: 0, ShinAccumMins: 0, ShinAccumCnts: 0}
+	Metrics := newMetricsCollector()
+	startWebhooks()
+	go runDigests(Metrics)
 	DeadorAlive := DeadorAlive{LastStsUpdated: float64(time.Now().Local().UnixMilli()), LastIgsUpdated: float64(time.Now().Local().UnixMilli()), DeadorAlive: `Fine`}
 	resStss, err := readFiles()
 	if err != nil {
@@ -135,23 +167,34 @@ func main() {
 	}
 	e := echo.New()
 	e.Use(middleware.CORS())
+	e.Use(promHttpMiddleware)
 	e.Static("/", "public/")
-	e.GET("/api/status", statusApi)
-	e.GET("/api/awb", apiFactory(awbApi, &STS))
-	e.GET("/api/user", apiFactory(userApi, &STS))
-	e.GET("/api/stslist", apiFactory(stslistApi, &STS))
+	e.GET("/api/status", storeApiFactory(statusApi, stsStore))
+	e.POST("/api/status/batch", storeApiFactory(statusBatchApi, stsStore))
+	e.GET("/api/awb", apiFactory(func(c echo.Context, snap *Snapshot) error { return awbApi(c, snap, stsStore) }))
+	e.GET("/api/awb/:awbno/history", storeApiFactory(historyApi, stsStore))
+	e.GET("/api/user", apiFactory(userApi))
+	e.GET("/api/stslist", apiFactory(stslistApi))
 	e.GET("/api/timeline", timeLineApi)
-	e.GET("/api/metrics", metApiFactory(metricsApi, &Metrics))
+	e.GET("/api/stream", streamApi)
+	e.GET("/api/metrics", metApiFactory(metricsApi, Metrics))
+	e.GET("/api/metrics/groups", groupMetricsApi)
 	e.GET("/api/deadoralive", deadApiFactory(deadoraliveApi, &DeadorAlive))
+	e.GET("/api/ingest/errors", ingestErrorsApi)
+	e.GET("/api/store/stats", storeStatsApi)
+	e.GET("/metrics", promMetricsApi)
+	e.GET("/api/health", healthApi)
+	e.GET("/api/alerts", alertsApi)
+	e.GET("/api/digest/preview", metApiFactory(digestPreviewApi, Metrics))
+	e.GET("/healthz/live", livenessApi)
+	e.GET("/healthz/ready", readinessApi)
 
 	go func() {
 		for {
 			ressts := <-resStss
 			if ressts.Result != nil {
-				DeadorAlive.LastStsUpdated = float64(time.Now().UnixMilli())
-				for k := range STS {
-					delete(STS, k)
-				}
+				DeadorAlive.setUpdated(true, time.Now())
+				STS := make(map[string]AwbStatus)
 				prevawb := ""
 				if ressts.Result != nil && len(ressts.Result) > 0 {
 					prevawb = ressts.Result[0].Awbno
@@ -165,172 +208,34 @@ func main() {
 					}
 					STS[prevawb] = prevstatus
 				}
+				prev := currentSnapshot()
+				swapSnapshot(STS)
+				publishDiff(diffStatuses(prev.Awbs, STS))
+				now := time.Now()
+				notifyWebhooks(statusWebhookEvents(prev, STS, now))
+				notifyWebhooks(alertWebhookEvents(alerts.evaluate(STS, now)))
 			} else {
-				if ressts.Error != nil {
-					log.Fatalf("%s", ressts.Error)
-				} else {
-					DeadorAlive.LastIgsUpdated = float64(time.Now().UnixMilli())
-				}
+				DeadorAlive.setUpdated(false, time.Now())
 			}
 
 			//calculate metrics
-			survayAwbs := make([]string, 0, 100)
-			for _, status := range ressts.Result {
-				if SakuBlackList[status.Awbno] {
-					continue
-				}
-				if status.StatusCode < "70" {
-					continue
-				} else {
-					survayAwbs = append(survayAwbs, status.Awbno)
-				}
-			}
-			durs, err := getDurations(survayAwbs, "50", "70")
-			if err != nil {
-				log.Printf("%s", err)
-			}
-			for _, dur := range durs {
-				if dur != 0 {
-					Metrics.SakuAccumCnts++
-					Metrics.SakuAccumMins += dur
-				}
-			}
-			for _, awb := range survayAwbs {
-				SakuBlackList[awb] = true
-			}
-
-			survayAwbs = make([]string, 0, 100)
-			for _, status := range ressts.Result {
-				if ShinBlackList[status.Awbno] {
-					continue
-				}
-				if status.StatusCode < "72" {
-					continue
-				} else {
-					survayAwbs = append(survayAwbs, status.Awbno)
-				}
-			}
-			durs, err = getDurations(survayAwbs, "70", "72")
-			if err != nil {
-				log.Printf("%s", err)
-			}
-			for _, dur := range durs {
-				if dur != 0 {
-					Metrics.ShinAccumCnts++
-					Metrics.ShinAccumMins += dur
-				}
-			}
-			for _, awb := range survayAwbs {
-				ShinBlackList[awb] = true
-			}
+			Metrics.update(ressts.Result)
 		}
 	}()
 	e.Logger.Debug(e.Start(":8080"))
 }
 
-func getDurations(awbs []string, gte, lt string) ([]float64, error) {
-	from := time.Now().UnixMilli() / (24 * 60 * 60 * 1000) * (24 * 60 * 60 * 1000)
-	to := time.Now().UnixMilli()
-	var r map[string]interface{}
-	muniteUnit := int64(60 * 1000)
-	result := make([]float64, 0, 100)
-
-	cfg := elasticsearch.Config{
-		Addresses: []string{
-			"http://localhost:9200",
-		},
-		Transport: &Tp,
-	}
-
-	es7, err := elasticsearch.NewClient(cfg)
-	if err != nil {
-		return nil, err
-	}
-
-	for _, awb := range awbs {
-		qbody := strings.NewReader(`{"sort": [{"update_time": {"order": "asc"}}],"query":{"bool":{"must": [{"term":{"awb_no": {"value": "` + awb + `"}}},{"range":{"update_time": {"gte":` + strconv.FormatInt(from, 10) + `,"lt":` + strconv.FormatInt(to, 10) + `}}}]}}}`)
-		size := 1000
-		req := esapi.SearchRequest{
-			Index: []string{es_sts_idx},
-			Body:  qbody,
-			Size:  &size,
-		}
-		res, err := req.Do(context.Background(), es7.Transport)
-		if err != nil {
-			log.Printf("%v", err)
-		}
-		defer func() {
-			io.Copy(ioutil.Discard, res.Body)
-			res.Body.Close()
-		}()
-		if err := json.NewDecoder(res.Body).Decode(&r); err != nil {
-			log.Printf("Error parsing the response body: %s", err)
-		}
-		hits := r["hits"].(map[string]interface{})["hits"].([]interface{})
-		isOK := false
-		contidx := 0
-		for idx, hit := range hits {
-			data := hit.(map[string]interface{})["_source"]
-			sts_code, _ := data.(map[string]interface{})["sts_code"].(string)
-			if sts_code < gte {
-				isOK = true
-				contidx = idx + 1
-				break
-			}
-		}
-		if !isOK {
-			result = append(result, 0)
-			continue
-		}
-		isOK = false
-		startidx := 0
-		for idx := contidx; idx < len(hits); idx++ {
-			data := hits[idx].(map[string]interface{})["_source"]
-			sts_code, _ := data.(map[string]interface{})["sts_code"].(string)
-			if sts_code >= gte {
-				isOK = true
-				startidx = idx
-				contidx = idx + 1
-				break
-			}
-		}
-		if !isOK {
-			result = append(result, 0)
-			continue
-		}
-		isOK = false
-		endidx := 0
-		for idx := contidx; idx < len(hits); idx++ {
-			data := hits[idx].(map[string]interface{})["_source"]
-			sts_code, _ := data.(map[string]interface{})["sts_code"].(string)
-			if sts_code >= lt {
-				isOK = true
-				endidx = idx
-				break
-			}
-		}
-		if !isOK {
-			result = append(result, 0)
-			continue
-		}
-		start := hits[startidx].(map[string]interface{})["_source"]
-		starttime := start.(map[string]interface{})["update_time"].(float64)
-		end := hits[endidx].(map[string]interface{})["_source"]
-		endtime := end.(map[string]interface{})["update_time"].(float64)
-		dur := endtime - starttime
-		result = append(result, dur/float64(muniteUnit))
-	}
-	return result, nil
-}
-
+// statusは従来どおりDeadかFine。取り込み元ごとの状態はhealthを参照する
 func deadoraliveApi(c echo.Context, dead *DeadorAlive) error {
-	var duration float64
-	duration = float64(time.Now().UnixMilli()) - dead.LastIgsUpdated
-	if float64(time.Now().UnixMilli())-dead.LastStsUpdated > duration {
-		duration = float64(time.Now().UnixMilli()) - dead.LastStsUpdated
+	stsUpdated, igsUpdated := dead.lastUpdated()
+	tempDead := DeadorAlive{LastStsUpdated: stsUpdated, LastIgsUpdated: igsUpdated, Errors: make([]SourceErrors, 0, 4), Health: healthReport()}
+	//失敗が続いている取り込み元
+	for _, src := range ingestErrors.list() {
+		if src.ConsecutiveFailures > 0 {
+			tempDead.Errors = append(tempDead.Errors, src)
+		}
 	}
-	tempDead := DeadorAlive{LastStsUpdated: dead.LastStsUpdated, LastIgsUpdated: dead.LastIgsUpdated}
-	if duration > float64(10*60*1000) {
+	if tempDead.Health.State == healthDown {
 		tempDead.DeadorAlive = `Dead`
 	} else {
 		tempDead.DeadorAlive = `Fine`
@@ -338,9 +243,6 @@ func deadoraliveApi(c echo.Context, dead *DeadorAlive) error {
 	return c.JSON(http.StatusOK, tempDead)
 }
 
-func metricsApi(c echo.Context, met *Metrics) error {
-	return c.JSON(http.StatusOK, *met)
-}
 func deadApiFactory(fn func(echo.Context, *DeadorAlive) error, dead *DeadorAlive) echo.HandlerFunc {
 	return func(c echo.Context) error {
 		fn(c, dead)
@@ -348,37 +250,34 @@ func deadApiFactory(fn func(echo.Context, *DeadorAlive) error, dead *DeadorAlive
 	}
 }
 
-func metApiFactory(fn func(echo.Context, *Metrics) error, met *Metrics) echo.HandlerFunc {
+func metApiFactory(fn func(echo.Context, *metricsCollector) error, met *metricsCollector) echo.HandlerFunc {
 	return func(c echo.Context) error {
 		fn(c, met)
 		return nil
 	}
 }
 
-func apiFactory(fn func(echo.Context, *map[string]AwbStatus) error, awbs *map[string]AwbStatus) echo.HandlerFunc {
+// 格納先を参照するAPI。テストではnewMemStore()を渡す
+func storeApiFactory(fn func(echo.Context, StatusStore) error, s StatusStore) echo.HandlerFunc {
 	return func(c echo.Context) error {
-		fn(c, awbs)
+		fn(c, s)
 		return nil
 	}
 }
 
-func stslistApi(c echo.Context, awbs *map[string]AwbStatus) error {
-	stsTable := make(map[string]bool)
-	for _, value := range *awbs {
-		stsTable[value.StatusCode] = true
-	}
-
-	result := StslistResponce{StatusCode: make([]string, 0, 100)}
-	for s, _ := range stsTable {
-		result.StatusCode = append(result.StatusCode, s)
+// 処理中に取り込みが行われても同じスナップショットを参照する
+func apiFactory(fn func(echo.Context, *Snapshot) error) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		snap := currentSnapshot()
+		c.Response().Header().Set("X-Snapshot-Version", snap.versionHeader())
+		fn(c, snap)
+		return nil
 	}
-	sort.SliceStable(result.StatusCode, func(i, j int) bool { return result.StatusCode[i] < result.StatusCode[j] })
-	return c.JSON(http.StatusOK, result)
 }
 
-func userApi(c echo.Context, awbs *map[string]AwbStatus) error {
+func userApi(c echo.Context, snap *Snapshot) error {
 	userTable := make(map[string]bool)
-	for _, value := range *awbs {
+	for _, value := range snap.Awbs {
 		if value.LastUserName != "" {
 			if c.QueryParam("status") == "" {
 				userTable[value.LastUserName] = true
@@ -387,17 +286,18 @@ func userApi(c echo.Context, awbs *map[string]AwbStatus) error {
 			}
 		}
 	}
-	result := UserResponce{User: make([]string, 0, 100)}
+	result := UserResponce{User: make([]string, 0, 100), Version: snap.Version}
 	for u, _ := range userTable {
 		result.User = append(result.User, u)
 	}
 	return c.JSON(http.StatusOK, result)
 }
 
-func awbApi(c echo.Context, awbs *map[string]AwbStatus) error {
-	result := AWBResponce{Awbno: make([]string, 0, 100), TtlAwbs: 0}
+// isupdate=trueの場合は格納先から直近の更新を取得する
+func awbApi(c echo.Context, snap *Snapshot, s StatusStore) error {
+	result := AWBResponce{Awbno: make([]string, 0, 100), TtlAwbs: 0, Version: snap.Version}
 	values := make([]AwbStatus, 0, 100)
-	for _, value := range *awbs {
+	for _, value := range snap.Awbs {
 		values = append(values, value)
 	}
 	sort.SliceStable(values, func(i, j int) bool { return values[i].Awbno < values[j].Awbno })
@@ -441,9 +341,9 @@ func awbApi(c echo.Context, awbs *map[string]AwbStatus) error {
 			}
 		case "status":
 			if c.QueryParam("isdesc") != "true" {
-				sort.SliceStable(values, func(i, j int) bool { return values[i].StatusCode < values[j].StatusCode })
+				sort.SliceStable(values, func(i, j int) bool { return statusBefore(values[i].StatusCode, values[j].StatusCode) })
 			} else {
-				sort.SliceStable(values, func(i, j int) bool { return values[i].StatusCode > values[j].StatusCode })
+				sort.SliceStable(values, func(i, j int) bool { return statusBefore(values[j].StatusCode, values[i].StatusCode) })
 			}
 		case "company_name":
 			if c.QueryParam("isdesc") != "true" {
@@ -495,7 +395,7 @@ func awbApi(c echo.Context, awbs *map[string]AwbStatus) error {
 		blacklist := make(map[string]bool)
 		if totime, err := strconv.ParseInt(c.QueryParam("lastupdated"), 10, 64); err == nil {
 			lasttime := (totime - (10 * 60 * 1000)) / (10 * 60 * 1000) * (10 * 60 * 1000)
-			laststss, err = getLatestAwbs(lasttime, totime, 10)
+			laststss, err = getLatestAwbs(s, lasttime, totime, 10)
 			if err != nil {
 				log.Printf("Error getting Latest Awbs: %s", err)
 			}
@@ -552,7 +452,7 @@ func awbApi(c echo.Context, awbs *map[string]AwbStatus) error {
 		from := page * par
 		to := (page + 1) * par
 		if from > len(result.Awbno)-1 {
-			return c.JSON(http.StatusBadRequest, AWBResponce{Awbno: nil, TtlAwbs: 0})
+			return c.JSON(http.StatusBadRequest, AWBResponce{Awbno: nil, TtlAwbs: 0, Version: snap.Version})
 		} else if to > len(result.Awbno) {
 			to = len(result.Awbno)
 		}
@@ -607,7 +507,7 @@ func timeLineApi(c echo.Context) error {
 	return c.JSON(http.StatusOK, result)
 }
 
-func statusApi(c echo.Context) error {
+func statusApi(c echo.Context, s StatusStore) error {
 	awbno := c.QueryParam("key")
 	from := c.QueryParam("from")
 	to := c.QueryParam("to")
@@ -619,8 +519,9 @@ func statusApi(c echo.Context) error {
 	if err != nil {
 		return c.JSON(http.StatusBadRequest, nil)
 	}
-	if awbno == "" {
-		return c.JSON(http.StatusBadRequest, nil)
+	awbno, err = normalizeAwbKey(awbno)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorResponce{Error: err.Error()})
 	}
 
 	isLatest := false
@@ -630,7 +531,7 @@ func statusApi(c echo.Context) error {
 	} else if c.QueryParam("isupdate") == "true" {
 		isUpdate = true
 	}
-	awbstatus, err := getAwbStatuses(from_i64, to_i64, awbno, 10, isLatest, isUpdate)
+	awbstatus, err := getAwbStatuses(s, from_i64, to_i64, awbno, 10, isLatest, isUpdate)
 	if err != nil {
 		log.Printf("%s", err)
 	}
@@ -638,235 +539,131 @@ func statusApi(c echo.Context) error {
 }
 
 func Init() error {
-	cfg := elasticsearch.Config{
-		Addresses: []string{
-			"http://localhost:9200",
-		},
-		Transport: &Tp,
+	if err := GetSettings(); err != nil {
+		return err
 	}
-
-	es7, err := elasticsearch.NewClient(cfg)
+	if err := validateStsColumns(); os.IsNotExist(err) {
+		log.Printf("STSファイルがないため列の確認を省略します:%s", err)
+	} else if err != nil {
+		return err
+	}
+	store, err := newStatusStore(storeType)
 	if err != nil {
 		return err
 	}
+	stsStore = store
+	alerts.store = store
 	deleteFrom, err := strconv.Atoi(deleteIndiciesfrom)
 	if err != nil {
 		deleteFrom = 3
 	}
-	for minus := 1; minus < deleteFrom+1; minus++ {
-		name := `sts_index_` + time.Now().AddDate(0, 0, minus*-1).Format("20060102")
-		req := esapi.IndicesExistsRequest{
-			Index: []string{name},
-		}
-
-		res, err := req.Do(context.Background(), es7.Transport)
-		if err != nil {
-			return err
-		}
-		defer func() {
-			io.Copy(ioutil.Discard, res.Body)
-			if res != nil {
-				res.Body.Close()
-			}
-		}()
-		if res.StatusCode == 200 {
-			req := esapi.IndicesDeleteRequest{
-				Index: []string{name},
-			}
-
-			res, err := req.Do(context.Background(), es7.Transport)
-			if err != nil {
-				return err
-			}
-			defer func() {
-				io.Copy(ioutil.Discard, res.Body)
-				if res != nil {
-					res.Body.Close()
-				}
-			}()
-		}
-	}
-
-	es_sts_idx = `sts_index_` + time.Now().Format("20060102")
-	//stsデータidx(トラン)の存在確認⇒なければ作成
-	req := esapi.IndicesExistsRequest{
-		Index: []string{es_sts_idx},
-	}
-
-	res, err := req.Do(context.Background(), es7.Transport)
-	if err != nil {
+	if err := stsStore.Purge(deleteFrom); err != nil {
 		return err
 	}
-	defer func() {
-		io.Copy(ioutil.Discard, res.Body)
-		if res != nil {
-			res.Body.Close()
-		}
-	}()
-	statuscode := res.StatusCode
-	if statuscode == 404 {
-		qbody := strings.NewReader(`{"mappings":{"properties":{"awb_no":{"type":"keyword","doc_values":true},"update_time":{"type":"date","doc_values":true},"sts_code":{"type":"keyword","doc_values":true},"last_updated_user":{"type":"keyword","doc_values":true},"last_updated_user_id":{"type":"keyword","doc_values":true},"company_name":{"type":"keyword","doc_values":true},"company_code":{"type":"keyword","doc_values":true},"section_code":{"type":"keyword","doc_values":true},"is_stocked":{"type":"boolean","doc_values":true},"igs_status":{"type":"keyword","doc_values":true}}}}`)
-		req := esapi.IndicesCreateRequest{
-			Index: es_sts_idx,
-			Body:  qbody,
-		}
-		res, err := req.Do(context.Background(), es7.Transport)
-		if err != nil {
-			return err
-		} else if res.StatusCode == 400 {
-			log.Fatalf("%v", res)
-			return errors.New("インデックス作成に失敗しました" + es_sts_idx)
-		}
-		defer func() {
-			io.Copy(ioutil.Discard, res.Body)
-			if res != nil {
-				res.Body.Close()
-			}
-		}()
-	}
-	if err := GetSettings(); err != nil {
+	if err := stsStore.Prepare(); err != nil {
 		return err
 	}
-	putGatewayHtml()
+	go rolloverDaily(deleteFrom)
+	//作成できなくても起動は続ける。状態は/api/healthで確認する
+	runIngest("gateway", putGatewayHtml)
 	return nil
 }
-func getLatestAwbs(from int64, to int64, timespan int) ([]Status, error) {
-	var r map[string]interface{}
+func getLatestAwbs(s StatusStore, from int64, to int64, timespan int) ([]Status, error) {
 	hourUnit := int64(3600000)
 	timeSpanUnit := int64(timespan * 60 * 1000)
 
-	cfg := elasticsearch.Config{
-		Addresses: []string{
-			"http://localhost:9200",
-		},
-		Transport: &Tp,
-	}
-
-	es7, err := elasticsearch.NewClient(cfg)
+	//変更があった時だけ記録されるため、fromより前の記録も引き継いで最新とする
+	docs, err := s.Latest(from-carryForwardWindow, to)
 	if err != nil {
 		return nil, err
 	}
-	qbody := strings.NewReader(`{"aggs": {"f": {"filter": {"range": {"update_time": {"gte":` + strconv.FormatInt(from, 10) + `,"lt":` + strconv.FormatInt(to, 10) + `}}},"aggs": {"awbs": {"terms": {"size": 10000, "field": "awb_no"},"aggs": {"latest": {"top_hits": {"size": 1,"sort": [{"update_time":{"order":"desc"}}]}}}}}}}}`)
-	size := 10000
-	req := esapi.SearchRequest{
-		Index: []string{es_sts_idx},
-		Body:  qbody,
-		Size:  &size,
-	}
-	res, err := req.Do(context.Background(), es7.Transport)
-	if err != nil {
-		log.Printf("%v", err)
-	}
-	defer func() {
-		io.Copy(ioutil.Discard, res.Body)
-		if res != nil {
-			res.Body.Close()
-		}
-	}()
-	if err := json.NewDecoder(res.Body).Decode(&r); err != nil {
-		log.Printf("Error parsing the response body: %s", err)
-	}
-	if err := json.NewDecoder(res.Body).Decode(&r); err != nil {
-		log.Printf("Error parsing the response body: %s", err)
-	}
 	result := make([]Status, 0, 100)
-	f := r["aggregations"].(map[string]interface{})["f"].(map[string]interface{})
-	aggs := f["awbs"].(map[string]interface{})["buckets"].([]interface{})
-	for idx, a := range aggs {
-		bucket := a.(map[string]interface{})
-		awb := bucket["key"].(string)
-		data := bucket["latest"].(map[string]interface{})["hits"].(map[string]interface{})["hits"].([]interface{})
-		if len(data) < 1 {
+	idx := 0
+	for _, doc := range docs {
+		if isRemoved(doc) {
 			continue
 		}
-		source := data[0].(map[string]interface{})["_source"].(map[string]interface{})
-
-		sts_code, _ := source["sts_code"].(string)
-		is_stocked, _ := source["is_stocked"].(bool)
-		update_time, _ := source["update_time"].(float64)
-		update_time_i64 := int64(update_time)
-		last_user, _ := source["last_updated_user"].(string)
-		last_user_id, _ := source["last_updated_user_id"].(string)
-		com_code, _ := source["company_code"].(string)
-		com_name, _ := source["company_name"].(string)
-		sec_code, _ := source["section_code"].(string)
-		igs_status, _ := source["igs_status"].(string)
-		basetime := (update_time_i64 / hourUnit) * hourUnit
-		q := int((update_time_i64 - basetime) / timeSpanUnit)
+		basetime := (doc.UpdateTime / hourUnit) * hourUnit
+		q := int((doc.UpdateTime - basetime) / timeSpanUnit)
 		result = append(result, Status{
 			Index:             idx,
-			Awbno:             awb,
-			StatusCode:        sts_code,
+			Awbno:             doc.Awbno,
+			StatusCode:        doc.StatusCode,
 			BaseTime:          time.Unix(basetime/1000, 0),
 			Q:                 q,
 			TimespanInMinutes: timespan,
-			SectionCode:       sec_code,
-			CompanyCode:       com_code,
-			CompanyName:       com_name,
-			LastUserName:      last_user,
-			LastUserId:        last_user_id,
-			IsStocked:         is_stocked,
-			IgsStatus:         igs_status,
+			SectionCode:       doc.SectionCode,
+			CompanyCode:       doc.CompanyCode,
+			CompanyName:       doc.CompanyName,
+			LastUserName:      doc.LastUserName,
+			LastUserId:        doc.LastUserId,
+			IsStocked:         doc.IsStocked,
+			IgsStatus:         doc.IgsStatus,
 		})
+		idx++
 	}
 	return result, nil
 }
 
-func getAwbStatuses(from int64, to int64, awbno string, timespan int, isLatest bool, isUpdate bool) ([]Status, error) {
+func getAwbStatuses(s StatusStore, from int64, to int64, awbno string, timespan int, isLatest bool, isUpdate bool) ([]Status, error) {
+	carried, hits, err := historyWithCarry(s, awbno, from, to)
+	if err != nil {
+		return nil, err
+	}
+	return awbTimeline(carried, hits, from, to, awbno, timespan, isLatest, isUpdate), nil
+}
+
+// 記録を時間帯(timespan分)ごとのステータスに並べる
+func awbTimeline(carried *StsDoc, hits []StsDoc, from int64, to int64, awbno string, timespan int, isLatest bool, isUpdate bool) []Status {
 	//from to UnixTime(millsec)
 	//timespan min
-	var r map[string]interface{}
 	hourUnit := int64(3600000)
 	timeSpanUnit := int64(timespan * 60 * 1000)
 
 	result := make([]Status, 0, 100)
 
-	cfg := elasticsearch.Config{
-		Addresses: []string{
-			"http://localhost:9200",
-		},
-		Transport: &Tp,
-	}
-
-	es7, err := elasticsearch.NewClient(cfg)
-	if err != nil {
-		return nil, err
-	}
-
-	qbody := strings.NewReader(`{"sort": [{"update_time": {"order": "asc"}}],"query":{"bool":{"must": [{"term":{"awb_no": {"value": "` + awbno + `"}}},{"range":{"update_time": {"gte":` + strconv.FormatInt(from, 10) + `,"lte":` + strconv.FormatInt(to, 10) + `}}}]}}}`)
-	size := 1000
-	req := esapi.SearchRequest{
-		Index: []string{es_sts_idx},
-		Body:  qbody,
-		Size:  &size,
-	}
-	res, err := req.Do(context.Background(), es7.Transport)
-	if err != nil {
-		log.Printf("%v", err)
-	}
-	defer func() {
-		io.Copy(ioutil.Discard, res.Body)
-		res.Body.Close()
-	}()
-	if err := json.NewDecoder(res.Body).Decode(&r); err != nil {
-		log.Printf("Error parsing the response body: %s", err)
+	//変更があった時だけ記録されるため、fromの時点の状態を先頭に補う
+	if carried != nil {
+		head := *carried
+		head.UpdateTime = from
+		hits = append([]StsDoc{head}, hits...)
 	}
+	now := time.Now().UnixMilli()
 	statusIdx := 0
-	hits := r["hits"].(map[string]interface{})["hits"].([]interface{})
 	if len(hits) > 0 {
-		data := hits[0].(map[string]interface{})["_source"]
-		p_sts_code, _ := data.(map[string]interface{})["sts_code"].(string)
-		p_is_stocked, _ := data.(map[string]interface{})["is_stocked"].(bool)
-		p_update_time, _ := data.(map[string]interface{})["update_time"].(float64)
-		p_update_time_i64 := int64(p_update_time)
-		p_last_user, _ := data.(map[string]interface{})["last_updated_user"].(string)
-		p_last_user_id, _ := data.(map[string]interface{})["last_updated_user_id"].(string)
-		p_com_code, _ := data.(map[string]interface{})["company_code"].(string)
-		p_com_name, _ := data.(map[string]interface{})["company_name"].(string)
-		p_sec_code, _ := data.(map[string]interface{})["section_code"].(string)
-		p_igs_status, _ := data.(map[string]interface{})["igs_status"].(string)
+		p_removed := isRemoved(hits[0])
+		p_sts_code := hits[0].StatusCode
+		p_is_stocked := hits[0].IsStocked
+		p_update_time_i64 := hits[0].UpdateTime
+		p_last_user := hits[0].LastUserName
+		p_last_user_id := hits[0].LastUserId
+		p_com_code := hits[0].CompanyCode
+		p_com_name := hits[0].CompanyName
+		p_sec_code := hits[0].SectionCode
+		p_igs_status := hits[0].IgsStatus
 		p_basetime := (p_update_time_i64 / hourUnit) * hourUnit
 		p_q := int((p_update_time_i64 - p_basetime) / timeSpanUnit)
+		//次の記録までは直前のステータスのまま。削除された後は"NA"
+		p_status := func(basetime int64, q int) Status {
+			if p_removed {
+				return Status{Index: statusIdx, Awbno: awbno, StatusCode: "NA", BaseTime: time.Unix(basetime/1000, 0), Q: q, TimespanInMinutes: timespan}
+			}
+			return Status{
+				Index:             statusIdx,
+				Awbno:             awbno,
+				StatusCode:        p_sts_code,
+				BaseTime:          time.Unix(basetime/1000, 0),
+				Q:                 q,
+				TimespanInMinutes: timespan,
+				SectionCode:       p_sec_code,
+				CompanyCode:       p_com_code,
+				CompanyName:       p_com_name,
+				LastUserName:      p_last_user,
+				LastUserId:        p_last_user_id,
+				IsStocked:         p_is_stocked,
+				IgsStatus:         p_igs_status,
+			}
+		}
 
 		//開始時刻のbasetimeとq
 		//最初のデータが存在する時刻までの「詰め物」の個数を計算する。
@@ -910,17 +707,16 @@ func getAwbStatuses(from int64, to int64, awbno string, timespan int, isLatest b
 		}
 		//c_q = p_q && c_basetime = p_basetime
 		for _, hit := range hits {
-			data := hit.(map[string]interface{})["_source"]
-			sts_code, _ := data.(map[string]interface{})["sts_code"].(string)
-			is_stocked, _ := data.(map[string]interface{})["is_stocked"].(bool)
-			update_time, _ := data.(map[string]interface{})["update_time"].(float64)
-			update_time_i64 := int64(update_time)
-			last_user, _ := data.(map[string]interface{})["last_updated_user"].(string)
-			last_user_id, _ := data.(map[string]interface{})["last_updated_user_id"].(string)
-			com_code, _ := data.(map[string]interface{})["company_code"].(string)
-			com_name, _ := data.(map[string]interface{})["company_name"].(string)
-			sec_code, _ := data.(map[string]interface{})["section_code"].(string)
-			igs_status, _ := data.(map[string]interface{})["igs_status"].(string)
+			sts_code := hit.StatusCode
+			is_stocked := hit.IsStocked
+			update_time_i64 := hit.UpdateTime
+			last_user := hit.LastUserName
+			last_user_id := hit.LastUserId
+			com_code := hit.CompanyCode
+			com_name := hit.CompanyName
+			sec_code := hit.SectionCode
+			igs_status := hit.IgsStatus
+			removed := isRemoved(hit)
 			c_basetime = (update_time_i64 / hourUnit) * hourUnit
 			c_q = int((update_time_i64 - c_basetime) / timeSpanUnit)
 
@@ -928,21 +724,7 @@ func getAwbStatuses(from int64, to int64, awbno string, timespan int, isLatest b
 				hour_diff = int((c_basetime - p_basetime) / hourUnit)
 				whitespaces = hour_quarters*hour_diff + c_q - p_q - 1
 				for whitespaces > 0 {
-					result = append(result, Status{
-						Index:             statusIdx,
-						Awbno:             awbno,
-						StatusCode:        "NA",
-						BaseTime:          time.Unix(p_basetime/1000, 0),
-						Q:                 p_q,
-						TimespanInMinutes: timespan,
-						SectionCode:       "",
-						CompanyCode:       "",
-						CompanyName:       "",
-						LastUserName:      "",
-						LastUserId:        "",
-						IsStocked:         false,
-						IgsStatus:         "",
-					})
+					result = append(result, p_status(p_basetime, p_q))
 					statusIdx++
 					whitespaces--
 					if (p_q + 1) < hour_quarters {
@@ -952,26 +734,11 @@ func getAwbStatuses(from int64, to int64, awbno string, timespan int, isLatest b
 						p_basetime += hourUnit
 					}
 				}
-				result = append(result, Status{
-					Index:             statusIdx,
-					Awbno:             awbno,
-					StatusCode:        p_sts_code,
-					BaseTime:          time.Unix(p_basetime/1000, 0),
-					Q:                 int(p_q),
-					TimespanInMinutes: timespan,
-					SectionCode:       p_sec_code,
-					CompanyCode:       p_com_code,
-					CompanyName:       p_com_name,
-					LastUserName:      p_last_user,
-					LastUserId:        p_last_user_id,
-					IsStocked:         p_is_stocked,
-					IgsStatus:         p_igs_status,
-				})
+				result = append(result, p_status(p_basetime, p_q))
 				statusIdx++
 			}
 			p_sts_code = sts_code
 			p_is_stocked = is_stocked
-			p_update_time = update_time
 			p_update_time_i64 = update_time_i64
 			p_last_user = last_user
 			p_last_user_id = last_user_id
@@ -979,24 +746,11 @@ func getAwbStatuses(from int64, to int64, awbno string, timespan int, isLatest b
 			p_com_name = com_name
 			p_sec_code = sec_code
 			p_igs_status = igs_status
+			p_removed = removed
 			p_basetime = c_basetime
 			p_q = c_q
 		}
-		result = append(result, Status{
-			Index:             statusIdx,
-			Awbno:             awbno,
-			StatusCode:        p_sts_code,
-			BaseTime:          time.Unix(p_basetime/1000, 0),
-			Q:                 int(p_q),
-			TimespanInMinutes: timespan,
-			SectionCode:       p_sec_code,
-			CompanyCode:       p_com_code,
-			CompanyName:       p_com_name,
-			LastUserName:      p_last_user,
-			LastUserId:        p_last_user_id,
-			IsStocked:         p_is_stocked,
-			IgsStatus:         p_igs_status,
-		})
+		result = append(result, p_status(p_basetime, p_q))
 		statusIdx++
 		if (c_q + 1) < hour_quarters {
 			c_q++
@@ -1014,21 +768,26 @@ func getAwbStatuses(from int64, to int64, awbno string, timespan int, isLatest b
 			whitespaces = hour_quarters*hour_diff + to_q - c_q
 		}
 		for whitespaces > 0 {
-			result = append(result, Status{
-				Index:             statusIdx,
-				Awbno:             awbno,
-				StatusCode:        "NA",
-				BaseTime:          time.Unix(c_basetime/1000, 0),
-				Q:                 int(c_q),
-				TimespanInMinutes: timespan,
-				SectionCode:       "",
-				CompanyCode:       "",
-				CompanyName:       "",
-				LastUserName:      "",
-				LastUserId:        "",
-				IsStocked:         false,
-				IgsStatus:         "",
-			})
+			//現在時刻までは最後のステータスを引き継ぐ
+			if c_basetime+int64(c_q)*timeSpanUnit <= now {
+				result = append(result, p_status(c_basetime, c_q))
+			} else {
+				result = append(result, Status{
+					Index:             statusIdx,
+					Awbno:             awbno,
+					StatusCode:        "NA",
+					BaseTime:          time.Unix(c_basetime/1000, 0),
+					Q:                 int(c_q),
+					TimespanInMinutes: timespan,
+					SectionCode:       "",
+					CompanyCode:       "",
+					CompanyName:       "",
+					LastUserName:      "",
+					LastUserId:        "",
+					IsStocked:         false,
+					IgsStatus:         "",
+				})
+			}
 			statusIdx++
 			whitespaces--
 			if (c_q + 1) < hour_quarters {
@@ -1038,9 +797,9 @@ func getAwbStatuses(from int64, to int64, awbno string, timespan int, isLatest b
 				c_basetime += hourUnit
 			}
 		}
-		return result, nil
+		return result
 	} else {
-		return nil, nil
+		return nil
 	}
 }
 
@@ -1052,7 +811,8 @@ func GetSettings() error {
 	lines := strings.Split(string(b), "\n")
 	settings := make(map[string]string)
 	for _, line := range lines {
-		kv := strings.Split(line, "=")
+		//APIキー等の値に"="を含められるように最初の"="で分割する
+		kv := strings.SplitN(strings.TrimRight(line, "\r"), "=", 2)
 		if len(kv) < 2 {
 			continue
 		}
@@ -1118,22 +878,54 @@ func GetSettings() error {
 		return errors.New("DeleteIndiciesfromが設定されていません")
 	}
 	deleteIndiciesfrom = settings["DeleteIndiciesfrom"]
+	//未設定ならelasticsearch
+	storeType = settings["StoreType"]
+	//StoreType=fileの場合の保存先
+	storeFolderPath = settings["StoreFolderPath"]
+	if err := loadArchiveSettings(settings); err != nil {
+		return err
+	}
+	if stsFormat, err = loadFeedFormat(settings, "STS", "ShiftJIS"); err != nil {
+		return err
+	}
+	if igsFormat, err = loadFeedFormat(settings, "IGS", "UTF8"); err != nil {
+		return err
+	}
+	if err := loadStsColumnSettings(settings); err != nil {
+		return err
+	}
+	if err := loadWatchSettings(settings); err != nil {
+		return err
+	}
+	if err := loadChangeSettings(settings); err != nil {
+		return err
+	}
+	if err := loadMetricSettings(settings); err != nil {
+		return err
+	}
+	if err := loadEsSettings(settings); err != nil {
+		return err
+	}
+	if err := loadHealthSettings(settings); err != nil {
+		return err
+	}
+	if err := loadAlertSettings(settings); err != nil {
+		return err
+	}
+	if err := loadWebhookSettings(settings); err != nil {
+		return err
+	}
+	if err := loadDigestSettings(settings); err != nil {
+		return err
+	}
+	if err := loadStatusCatalogSettings(settings); err != nil {
+		return err
+	}
 	return nil
 }
 
 func readFiles() (chan STSResult, error) {
 	resChan := make(chan STSResult)
-	cfg := elasticsearch.Config{
-		Addresses: []string{
-			"http://localhost:9200",
-		},
-		Transport: &Tp,
-	}
-
-	es7, err := elasticsearch.NewClient(cfg)
-	if err != nil {
-		return nil, err
-	}
 	stslockfile := lockFolderPath + `\` + stsLockFileName
 	stsoriginfile := lockFolderPath + `\` + stsLinkFileName
 	sts75lockfile := lockFolderPath + `\` + sts75ListLockFileName
@@ -1141,24 +933,72 @@ func readFiles() (chan STSResult, error) {
 	igsoriginfile := lockFolderPath + `\` + igsLinkFileName
 	igslockfile := lockFolderPath + `\` + igsLockFileName
 	igsMap := make(map[string]string)
+	tracker := &changeTracker{store: stsStore}
+	//失敗した場合は次の周期を待たずに待ち時間を空けて再試行する
+	readSts := func() <-chan time.Time {
+		if wait, failed := runIngest("sts", func() error {
+			return readSTSfile(igsMap, tracker, resChan, stslockfile, stsoriginfile, sts75lockfile, sts75originfile)
+		}); failed {
+			return time.After(wait)
+		}
+		return nil
+	}
+	readIgs := func() <-chan time.Time {
+		if wait, failed := runIngest("igs", func() error {
+			return readIgsFile(igsMap, resChan, igslockfile, igsoriginfile)
+		}); failed {
+			return time.After(wait)
+		}
+		return nil
+	}
+	//ファイルの変更通知で読み込む。監視できない場合は一定間隔の読み込みのみ行う
+	var changed <-chan string
+	if watchEnabled {
+		var err error
+		if changed, err = watchFeeds(); err != nil {
+			watchEnabled = false
+			usePollingIntervals()
+			log.Printf("ファイルの監視を開始できません。STS:%s IGS:%s間隔で読み込みます:%s", stsPollInterval, igsPollInterval, err)
+		}
+	}
 	go func() {
 		for {
 			deadman := time.After(30 * time.Minute)
 			func() {
 				//setting Timers
-				igsTicker := time.NewTicker(30 * time.Second)
+				igsTicker := time.NewTicker(igsPollInterval)
 				time.Sleep(5 * time.Second)
-				stsTicker := time.NewTicker(90 * time.Second)
+				stsTicker := time.NewTicker(stsPollInterval)
 				defer func() {
 					stsTicker.Stop()
 					igsTicker.Stop()
 				}()
+				var stsRetry, igsRetry <-chan time.Time
 				for {
 					select {
+					case src := <-changed:
+						//通知で読み込んだ場合は定期読み込みを先送りする
+						if src == "sts" && stsRetry == nil {
+							stsTicker.Reset(stsPollInterval)
+							stsRetry = readSts()
+						} else if src == "igs" && igsRetry == nil {
+							igsTicker.Reset(igsPollInterval)
+							igsRetry = readIgs()
+						}
 					case <-stsTicker.C:
-						readSTSfile(igsMap, resChan, stslockfile, stsoriginfile, sts75lockfile, sts75originfile, es7)
+						if stsRetry != nil {
+							continue
+						}
+						stsRetry = readSts()
+					case <-stsRetry:
+						stsRetry = readSts()
 					case <-igsTicker.C:
-						readIgsFile(igsMap, resChan, igslockfile, igsoriginfile)
+						if igsRetry != nil {
+							continue
+						}
+						igsRetry = readIgs()
+					case <-igsRetry:
+						igsRetry = readIgs()
 					case <-deadman:
 						log.Println("Deadman Awake")
 						return
@@ -1170,217 +1010,138 @@ func readFiles() (chan STSResult, error) {
 	return resChan, nil
 }
 
-func readSTSfile(igsMap map[string]string, resChan chan STSResult, stslockfile, stsoriginfile, sts75lockfile, sts75originfile string, es7 *elasticsearch.Client) {
-	maxUpdateSTS := 10
-	//cfg := elasticsearch.Config{
-	//	Addresses: []string{
-	//		"http://localhost:9200",
-	//	},
-	//	Transport: &Tp,
-	//}
-
-	//es7, err := elasticsearch.NewClient(cfg)
-	//if err != nil {
-	//	resChan <- STSResult{Result: nil, Error: err}
-	//}
-	//stsTicker := time.NewTicker(30 * time.Second)
-	//stslockfile := lockFolderPath + `\` + stsLockFileName
-	//stsoriginfile := lockFolderPath + `\` + stsLinkFileName
-	//sts75lockfile := lockFolderPath + `\` + sts75ListLockFileName
-	//sts75originfile := lockFolderPath + `\` + sts75ListLinkFileName
-
-	awbs := make([]string, 0, 100)
-	brs := make([]string, 0, 100)
-	stss := make([]string, 0, 100)
-	users := make([]string, 0, 100)
-	userids := make([]string, 0, 100)
-	coms := make([]string, 0, 100)
-	comcds := make([]string, 0, 100)
-	secs := make([]string, 0, 100)
+func readSTSfile(igsMap map[string]string, tracker *changeTracker, resChan chan STSResult, stslockfile, stsoriginfile, sts75lockfile, sts75originfile string) error {
+	rows := make([]stsRow, 0, 100)
 	log.Printf("STSファイルの読み込みを開始します")
-	if err := os.Link(stsoriginfile, stslockfile); err != nil {
-		cntr := 0
-		for {
-			err := os.Link(stsoriginfile, stslockfile)
-			if err != nil {
-				time.Sleep(time.Second * 1)
-				cntr++
-				if cntr > 30 {
-					log.Println("30秒待ちましたがロックが解除されません。ロックファイルを強制削除します" + ":" + stslockfile)
-					os.Remove(stslockfile)
-					continue
-				}
-			} else {
-				break
-			}
-		}
+	if err := acquireLock("sts", stsoriginfile, stslockfile); err != nil {
+		return err
 	}
-	f, err := os.Open(stsFilePath)
-	if err != nil {
-		resChan <- STSResult{Result: nil, Error: err}
-	}
-	r := csv.NewReader(transform.NewReader(f, japanese.ShiftJIS.NewDecoder()))
-	r.Read()
-	record, _ := r.Read()
-	prevawb := strings.TrimSpace(record[2])
-	prevbr := strings.TrimSpace(record[3])
-	prevsts := strings.TrimSpace(record[7])
-	prevusr := strings.TrimSpace(record[12])
-	prevuserid := strings.TrimSpace(record[11])
-	prevcom := strings.TrimSpace(record[6])
-	prevcomcd := strings.TrimSpace(record[5])
-	prevsec := strings.TrimSpace(record[1])
-	for {
-		record, err = r.Read()
-		if err == io.EOF {
-			awbs = append(awbs, prevawb)
-			brs = append(brs, prevbr)
-			stss = append(stss, prevsts)
-			users = append(users, prevusr)
-			userids = append(userids, prevuserid)
-			coms = append(coms, prevcom)
-			comcds = append(comcds, prevcomcd)
-			secs = append(secs, prevsec)
-			break
-		} else if record[0] == "\x1a" {
-			continue
-		} else if err != nil {
-			resChan <- STSResult{Result: nil, Error: err}
+	err := func() error {
+		defer os.Remove(stslockfile)
+		f, err := os.Open(stsFilePath)
+		if err != nil {
+			return err
 		}
-		if (prevawb + "-" + prevbr) != (strings.TrimSpace(record[2]) + "-" + strings.TrimSpace(record[3])) {
-			awbs = append(awbs, prevawb)
-			brs = append(brs, prevbr)
-			stss = append(stss, prevsts)
-			users = append(users, prevusr)
-			userids = append(userids, prevuserid)
-			coms = append(coms, prevcom)
-			comcds = append(comcds, prevcomcd)
-			secs = append(secs, prevsec)
+		defer f.Close()
+		r, err := stsFormat.newReader(f)
+		if err != nil {
+			return err
 		}
-		prevawb = strings.TrimSpace(record[2])
-		prevbr = strings.TrimSpace(record[3])
-		prevsts = strings.TrimSpace(record[7])
-		prevusr = strings.TrimSpace(record[12])
-		prevuserid = strings.TrimSpace(record[11])
-		prevcom = strings.TrimSpace(record[6])
-		prevcomcd = strings.TrimSpace(record[5])
-		prevsec = strings.TrimSpace(record[1])
-	}
-	f.Close()
-	update_time := time.Now().UnixNano() / int64(time.Millisecond)
-
-	bbody_str := ""
-	for i := 0; i < len(awbs); i++ {
-		awb := awbs[i]
-		oriawb := awb
-		if brs[i] != "0" {
-			awb += "-" + brs[i]
+		header, err := readStsHeader(r)
+		if err != nil {
+			return err
 		}
-		sts := stss[i]
-		user := users[i]
-		userid := userids[i]
-		com := coms[i]
-		comcd := comcds[i]
-		sec := secs[i]
-		is_stocked := "false"
-		igs_status := igsMap[oriawb]
-		if igsMap[oriawb] == "" {
-			igs_status = "-1"
+		columns, err := resolveStsColumns(header)
+		if err != nil {
+			return err
 		}
-		bbody_str += `{ "create" : { "_index" : "` + es_sts_idx + `"}}` + "\n"
-		bbody_str += `{"awb_no":"` + awb + `","update_time":` + strconv.FormatInt(update_time, 10) + `,"sts_code":"` + sts + `","last_updated_user":"` + user + `","last_updated_user_id":"` + userid + `","company_name":"` + com + `","company_code":"` + comcd + `","section_code":"` + sec + `","is_stocked":` + is_stocked + `,"igs_status":"` + igs_status + `"}` + "\n"
-		if i%maxUpdateSTS == maxUpdateSTS-1 {
-			bbody := strings.NewReader(bbody_str)
-			breq := esapi.BulkRequest{
-				Index: es_sts_idx,
-				Body:  bbody,
+		//AWBと枝番が同じ行が続く場合は最後の行を使う
+		var prev *stsRow
+		for {
+			record, err := r.Read()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				return err
 			}
-			func() {
-				res, err := breq.Do(context.Background(), es7.Transport)
-				if err != nil {
-					resChan <- STSResult{Result: nil, Error: err}
-				} else if res.StatusCode == 400 {
-					log.Fatalf("データ登録に失敗 %v", res)
-				}
-				defer func() {
-					io.Copy(ioutil.Discard, res.Body)
-					if res != nil {
-						res.Body.Close()
-					}
-				}()
-			}()
-			bbody_str = ""
-		}
-	}
-	if bbody_str != "" {
-		bbody := strings.NewReader(bbody_str)
-		breq := esapi.BulkRequest{
-			Index: es_sts_idx,
-			Body:  bbody,
-		}
-		func() {
-			res, err := breq.Do(context.Background(), es7.Transport)
+			row, err := columns.row(record)
 			if err != nil {
-				resChan <- STSResult{Result: nil, Error: err}
-			} else if res.StatusCode == 400 {
-				log.Fatalf("データ登録に失敗 %v", res)
+				return err
 			}
-			defer func() {
-				io.Copy(ioutil.Discard, res.Body)
-				if res != nil {
-					res.Body.Close()
-				}
-			}()
-		}()
+			promRowsParsed.WithLabelValues("sts").Inc()
+			if prev != nil && (prev.Awb+"-"+prev.Branch) != (row.Awb+"-"+row.Branch) {
+				rows = append(rows, *prev)
+			}
+			prev = &row
+		}
+		if prev == nil {
+			return errors.New("STSファイルにデータがありません")
+		}
+		rows = append(rows, *prev)
+		return nil
+	}()
+	if err != nil {
+		return err
 	}
+	update_time := time.Now().UnixNano() / int64(time.Millisecond)
+	docs, awbStatuss := stsRowStatuses(rows, igsMap, update_time)
+	//登録に失敗しても読み込んだ内容は画面に反映する
+	runIngest("store", func() error {
+		now := time.UnixMilli(update_time)
+		events, heartbeat := tracker.diff(docs, now)
+		if len(events) > 0 {
+			if err := stsStore.Append(events); err != nil {
+				return err
+			}
+		}
+		tracker.commit(docs, now, heartbeat)
+		return nil
+	})
+	resChan <- STSResult{Result: awbStatuss}
+	runIngest("sts75", func() error {
+		return writeSts75File(igsMap, rows, sts75lockfile, sts75originfile)
+	})
+	return nil
+}
+
+// STSファイルの行から格納先に登録する記録と画面に返すステータスを作る。update_timeはUnixTime(millsec)
+func stsRowStatuses(rows []stsRow, igsMap map[string]string, update_time int64) ([]StsDoc, []AwbStatus) {
+	docs := make([]StsDoc, 0, len(rows))
 	awbStatuss := make([]AwbStatus, 0, 100)
-	for idx, _ := range awbs {
-		awb := awbs[idx]
-		if brs[idx] != "0" {
-			awb += "-" + brs[idx]
+	for _, row := range rows {
+		awb := row.Awb
+		if row.Branch != "0" {
+			awb += "-" + row.Branch
+		}
+		igs_status := igsMap[row.Awb]
+		if igsMap[row.Awb] == "" {
+			igs_status = "-1"
 		}
+		docs = append(docs, StsDoc{
+			Awbno:        awb,
+			UpdateTime:   update_time,
+			StatusCode:   row.Status,
+			LastUserName: row.UserName,
+			LastUserId:   row.UserId,
+			CompanyName:  row.CompanyName,
+			CompanyCode:  row.CompanyCode,
+			SectionCode:  row.Section,
+			IsStocked:    false,
+			IgsStatus:    igs_status,
+		})
 		awbStatuss = append(awbStatuss, AwbStatus{
 			Awbno:        awb,
-			UpdateTime:   time.Unix(update_time, 0),
-			StatusCode:   stss[idx],
-			SectionCode:  secs[idx],
-			CompanyCode:  coms[idx],
-			CompanyName:  comcds[idx],
-			LastUserName: users[idx],
-			LastUserId:   userids[idx],
+			UpdateTime:   time.UnixMilli(update_time),
+			StatusCode:   row.Status,
+			SectionCode:  row.Section,
+			CompanyCode:  row.CompanyCode,
+			CompanyName:  row.CompanyName,
+			LastUserName: row.UserName,
+			LastUserId:   row.UserId,
+			IgsStatus:    igs_status,
 		})
 	}
-	resChan <- STSResult{Result: awbStatuss, Error: err}
-	os.Remove(stslockfile)
+	return docs, awbStatuss
+}
+
+func writeSts75File(igsMap map[string]string, rows []stsRow, sts75lockfile, sts75originfile string) error {
 	log.Printf("STS75ファイルの書き出しを開始します")
-	if err := os.Link(sts75originfile, sts75lockfile); err != nil {
-		cntr := 0
-		for {
-			err := os.Link(sts75originfile, sts75lockfile)
-			if err != nil {
-				time.Sleep(time.Second * 1)
-				cntr++
-				if cntr > 30 {
-					log.Println("30秒待ちましたがロックが解除されません。ロックファイルを強制削除します" + ":" + sts75lockfile)
-					os.Remove(sts75lockfile)
-					continue
-				}
-			} else {
-				break
-			}
-		}
+	if err := acquireLock("sts75", sts75originfile, sts75lockfile); err != nil {
+		return err
 	}
+	defer os.Remove(sts75lockfile)
 	//sts75mapの初期化
 	temp75Map := make(map[string]bool)
-	for idx, awb := range awbs {
-		if stss[idx] == "75" && (igsMap[awb] == "0" || igsMap[awb] == "") {
-			temp75Map[awb] = true
+	for _, row := range rows {
+		if row.Status == sts75Status && (igsMap[row.Awb] == "0" || igsMap[row.Awb] == "") {
+			temp75Map[row.Awb] = true
 		}
 	}
 	ef, err := excelize.OpenFile(sts75FilePath)
 	if err != nil {
-		resChan <- STSResult{Result: nil, Error: err}
+		return err
 	}
+	defer ef.Close()
 	firstShName := ef.GetSheetName(0)
 	ef.NewSheet("temp")
 	ef.DeleteSheet(firstShName)
@@ -1391,49 +1152,32 @@ func readSTSfile(igsMap map[string]string, resChan chan STSResult, stslockfile,
 		ef.SetCellValue(firstShName, "A"+strconv.Itoa(cntr), awb)
 		cntr++
 	}
-	ef.SaveAs(sts75FilePath)
-	ef.Close()
-	os.Remove(sts75lockfile)
-
+	return ef.SaveAs(sts75FilePath)
 }
 
-func readIgsFile(igsMap map[string]string, resChan chan STSResult, igslockfile, igsoriginfile string) {
+func readIgsFile(igsMap map[string]string, resChan chan STSResult, igslockfile, igsoriginfile string) error {
 	log.Printf("IGSファイルの読み込みを開始します")
-	if err := os.Link(igsoriginfile, igslockfile); err != nil {
-		cntr := 0
-		for {
-			err := os.Link(igsoriginfile, igslockfile)
-			if err != nil {
-				time.Sleep(time.Second * 1)
-				cntr++
-				if cntr > 30 {
-					log.Println("30秒待ちましたがロックが解除されません。ロックファイルを強制削除します" + ":" + igslockfile)
-					os.Remove(igslockfile)
-					continue
-				}
-			} else {
-				break
-			}
-		}
+	if err := acquireLock("igs", igsoriginfile, igslockfile); err != nil {
+		return err
 	}
-	resChan <- STSResult{nil, nil}
+	defer os.Remove(igslockfile)
+	resChan <- STSResult{Result: nil}
 	//sts75mapの初期化..はしない
 	//igsMap = make(map[string]bool)
 	//igs確認済みのものはigsMapに追加され続ける。
 	blnofiles, err := findMatchedFiles(igsFolderPath, igsBLNOFileName)
 	if err != nil {
-		resChan <- STSResult{Result: nil, Error: err}
+		return err
 	}
 	if len(blnofiles) < 1 {
 		log.Println("BLNOファイルがありません")
-		os.Remove(igslockfile)
-		return
+		return nil
 	}
 	awbnos := make([]string, 0, 100)
 	for _, blnofile := range blnofiles {
-		b, err := ioutil.ReadFile(blnofile)
+		b, err := readFeedFile(igsFormat, blnofile)
 		if err != nil {
-			resChan <- STSResult{Result: nil, Error: err}
+			return err
 		}
 		lines := strings.Split(string(b), "\r\n")
 		for _, line := range lines {
@@ -1446,19 +1190,18 @@ func readIgsFile(igsMap map[string]string, resChan chan STSResult, igslockfile,
 	}
 	igsfiles, err := findMatchedFiles(igsFolderPath, igsFileName)
 	if err != nil {
-		resChan <- STSResult{Result: nil, Error: err}
+		return err
 	}
 
 	if len(igsfiles) < 1 {
 		log.Println("IGS結果のファイルがありません")
-		os.Remove(igslockfile)
-		return
+		return nil
 	}
 	igsStss := make([]string, 0, 100)
 	for _, igsFile := range igsfiles {
-		b, err := ioutil.ReadFile(igsFile)
+		b, err := readFeedFile(igsFormat, igsFile)
 		if err != nil {
-			resChan <- STSResult{Result: nil, Error: err}
+			return err
 		}
 		lines := strings.Split(string(b), "\r\n")
 		for _, line := range lines {
@@ -1469,6 +1212,7 @@ func readIgsFile(igsMap map[string]string, resChan chan STSResult, igslockfile,
 			igsStss = append(igsStss, line)
 		}
 	}
+	promRowsParsed.WithLabelValues("igs").Add(float64(len(igsStss)))
 	for i, igsSts := range igsStss {
 		if i > len(awbnos)-1 {
 			continue
@@ -1481,7 +1225,7 @@ func readIgsFile(igsMap map[string]string, resChan chan STSResult, igslockfile,
 	for _, igsFile := range igsfiles {
 		os.Remove(igsFile)
 	}
-	os.Remove(igslockfile)
+	return nil
 }
 
 func findMatchedFiles(root, pattern string) ([]string, error) {
@@ -1523,12 +1267,10 @@ func getLoacalIps() ([]string, error) {
 func putGatewayHtml() error {
 	ipaddr, err := getLoacalIps()
 	if err != nil {
-		log.Printf("%s", err)
-		return nil
+		return err
 	}
 	if f, err := os.Stat(gatewayPath); os.IsNotExist(err) || !f.IsDir() {
-		log.Println("GatewayPathに指定したディレクトリは存在しないかアクセスできません" + gatewayPath)
-		return nil
+		return errors.New("GatewayPathに指定したディレクトリは存在しないかアクセスできません" + gatewayPath)
 	}
 	if f, err := os.Stat(gatewayPath + `\` + gatewayHtml); os.IsNotExist(err) && f != nil && !f.IsDir() {
 		os.Remove(gatewayPath + `\` + gatewayHtml)
@@ -1543,23 +1285,19 @@ func putGatewayHtml() error {
 	lines = append(lines, `</HTML>`)
 	lines = append(lines, `</BODY>`)
 
-	func() {
-		file, err := os.Create(gatewayPath + `\` + gatewayHtml)
-		if err != nil {
-			log.Printf("%s", err)
-			return
-		}
-		defer file.Close()
+	file, err := os.Create(gatewayPath + `\` + gatewayHtml)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
 
-		for _, line := range lines {
-			_, err := file.WriteString(line)
-			// fmt.Fprint()の場合
-			// _, err := fmt.Fprint(file, line)
-			if err != nil {
-				log.Printf("%s", err)
-				return
-			}
+	for _, line := range lines {
+		_, err := file.WriteString(line)
+		// fmt.Fprint()の場合
+		// _, err := fmt.Fprint(file, line)
+		if err != nil {
+			return err
 		}
-	}()
+	}
 	return nil
 }
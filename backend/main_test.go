@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// 過去の正時。時間帯の区切りを固定するため
+func testBaseTime() time.Time {
+	return time.Now().Truncate(time.Hour).Add(-3 * time.Hour)
+}
+
+func newTestContext(method, target string) (echo.Context, *httptest.ResponseRecorder) {
+	req := httptest.NewRequest(method, target, nil)
+	rec := httptest.NewRecorder()
+	return echo.New().NewContext(req, rec), rec
+}
+
+func ms(t time.Time) string {
+	return strconv.FormatInt(t.UnixMilli(), 10)
+}
+
+func TestStatusApi(t *testing.T) {
+	s := newMemStore()
+	t0 := testBaseTime()
+	s.Append([]StsDoc{
+		{Awbno: "11111111", StatusCode: "50", UpdateTime: t0.Add(-30 * time.Minute).UnixMilli(), Event: eventChanged},
+		{Awbno: "11111111", StatusCode: "70", UpdateTime: t0.Add(25 * time.Minute).UnixMilli(), Event: eventChanged},
+		{Awbno: "22222222-1", StatusCode: "40", UpdateTime: t0.UnixMilli(), Event: eventChanged},
+	})
+
+	c, rec := newTestContext(http.MethodGet, "/api/status?key=11111111&from="+ms(t0)+"&to="+ms(t0.Add(time.Hour)))
+	if err := statusApi(c, s); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != http.StatusOK {
+		t.Fatalf("ステータスコードが違います:%d", rec.Code)
+	}
+	var res StatusResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	//fromより前の50を引き継ぎ、25分の時間帯から70になる
+	codes := make([]string, 0, len(res.Status))
+	for _, st := range res.Status {
+		codes = append(codes, st.StatusCode)
+	}
+	if strings.Join(codes, ",") != "50,50,70,70,70,70" {
+		t.Fatalf("ステータスが違います:%v", codes)
+	}
+
+	//枝番"0"は枝番なしとして検索する
+	c, rec = newTestContext(http.MethodGet, "/api/status?key=11111111-0&from="+ms(t0)+"&to="+ms(t0.Add(time.Hour)))
+	statusApi(c, s)
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil || len(res.Status) != 6 {
+		t.Fatalf("枝番0の検索結果が違います:%s", rec.Body)
+	}
+
+	for _, target := range []string{
+		"/api/status?key=1111%2F1111&from=" + ms(t0) + "&to=" + ms(t0.Add(time.Hour)),
+		"/api/status?key=11111111&from=x&to=" + ms(t0.Add(time.Hour)),
+	} {
+		c, rec = newTestContext(http.MethodGet, target)
+		statusApi(c, s)
+		if rec.Code != http.StatusBadRequest {
+			t.Fatalf("%s:ステータスコードが違います:%d", target, rec.Code)
+		}
+	}
+}
+
+func TestAwbApi(t *testing.T) {
+	s := newMemStore()
+	now := time.Now()
+	snap := &Snapshot{Version: 3, Time: now, Awbs: map[string]AwbStatus{
+		"11111111": {Awbno: "11111111", StatusCode: "70", LastUserName: "利用者B", UpdateTime: now.Add(-3 * time.Minute)},
+		"22222222": {Awbno: "22222222", StatusCode: "50", LastUserName: "利用者A", UpdateTime: now.Add(-2 * time.Minute)},
+		"33333333": {Awbno: "33333333", StatusCode: "70", LastUserName: "利用者A", UpdateTime: now.Add(-1 * time.Minute)},
+	}}
+	get := func(query string) (int, AWBResponce) {
+		c, rec := newTestContext(http.MethodGet, "/api/awb?"+query)
+		if err := awbApi(c, snap, s); err != nil {
+			t.Fatal(err)
+		}
+		var res AWBResponce
+		if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+			t.Fatal(err)
+		}
+		return rec.Code, res
+	}
+
+	if code, res := get(""); code != http.StatusOK || res.TtlAwbs != 3 || res.Version != 3 || strings.Join(res.Awbno, ",") != "11111111,22222222,33333333" {
+		t.Fatalf("一覧が違います:%d %+v", code, res)
+	}
+	if _, res := get("sort=status&isdesc=true"); strings.Join(res.Awbno, ",") != "11111111,33333333,22222222" {
+		t.Fatalf("ステータス順が違います:%+v", res)
+	}
+	if _, res := get("sort=last_updated&isdesc=true"); strings.Join(res.Awbno, ",") != "33333333,22222222,11111111" {
+		t.Fatalf("更新時刻順が違います:%+v", res)
+	}
+	if _, res := get("user=" + "%E5%88%A9%E7%94%A8%E8%80%85A" + "&sts=70"); strings.Join(res.Awbno, ",") != "33333333" {
+		t.Fatalf("絞り込みが違います:%+v", res)
+	}
+	if _, res := get("page=1&par=2"); res.TtlAwbs != 3 || strings.Join(res.Awbno, ",") != "33333333" {
+		t.Fatalf("ページが違います:%+v", res)
+	}
+	if code, _ := get("page=2&par=2"); code != http.StatusBadRequest {
+		t.Fatalf("範囲外のページのステータスコードが違います:%d", code)
+	}
+
+	//直近に更新されたAWBは除く。引き継ぎ期間より前の更新は対象外
+	s.Append([]StsDoc{
+		{Awbno: "11111111", StatusCode: "70", UpdateTime: now.Add(-5 * time.Minute).UnixMilli(), Event: eventChanged},
+		{Awbno: "22222222", StatusCode: "50", UpdateTime: now.Add(-48 * time.Hour).UnixMilli(), Event: eventChanged},
+	})
+	if _, res := get("isupdate=true&lastupdated=" + ms(now)); strings.Join(res.Awbno, ",") != "22222222,33333333" {
+		t.Fatalf("更新済みの除外が違います:%+v", res)
+	}
+}
+
+func TestDeadoraliveApi(t *testing.T) {
+	dead := &DeadorAlive{}
+	now := time.Now()
+	//取り込みのゴルーチンと同時に参照する
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 100; i++ {
+			dead.setUpdated(i%2 == 0, now)
+		}
+		close(done)
+	}()
+	for i := 0; i < 10; i++ {
+		c, _ := newTestContext(http.MethodGet, "/api/deadoralive")
+		deadoraliveApi(c, dead)
+	}
+	<-done
+	c, rec := newTestContext(http.MethodGet, "/api/deadoralive")
+	if err := deadoraliveApi(c, dead); err != nil {
+		t.Fatal(err)
+	}
+	var res DeadorAlive
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	if res.LastStsUpdated != float64(now.UnixMilli()) || res.LastIgsUpdated != float64(now.UnixMilli()) {
+		t.Fatalf("更新時刻が違います:%+v", res)
+	}
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// 所要時間を集計する区間。Fromのステータスになってから、Toのステータスになるまで
+type metricStage struct {
+	Name  string `json:"name"`
+	From  string `json:"from"`
+	To    string `json:"to"`
+	Label string `json:"label"`
+}
+
+// 区間ごとの集計。時間は分
+type StageMetrics struct {
+	metricStage
+	Count  int64   `json:"count"`
+	Total  float64 `json:"total"`
+	Mean   float64 `json:"mean"`
+	Median float64 `json:"median"`
+	P90    float64 `json:"p90"`
+}
+
+var metricStages []metricStage
+var businessDayHour int
+var businessDayMinute int
+
+// MetricStages=名前:開始ステータス:終了ステータス:表示名 をカンマ区切りで指定する
+// saku,shinは従来のsakuttl,shinttl等の項目にも出力する
+func loadMetricSettings(settings map[string]string) error {
+	v := settings["MetricStages"]
+	if v == "" {
+		v = "saku:50:70:作業,shin:70:72:申告"
+	}
+	metricStages = make([]metricStage, 0, 4)
+	names := make(map[string]bool)
+	for _, def := range strings.Split(v, ",") {
+		parts := strings.SplitN(strings.TrimSpace(def), ":", 4)
+		if len(parts) < 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+			return errors.New("MetricStagesが不正です:" + def)
+		}
+		if names[parts[0]] {
+			return errors.New("MetricStagesの名前が重複しています:" + parts[0])
+		}
+		names[parts[0]] = true
+		stage := metricStage{Name: parts[0], From: parts[1], To: parts[2], Label: parts[0]}
+		if len(parts) == 4 && parts[3] != "" {
+			stage.Label = parts[3]
+		}
+		metricStages = append(metricStages, stage)
+	}
+	//BusinessDayStart=営業日の切り替え時刻(HH:MM)。未設定なら0:00
+	businessDayHour, businessDayMinute = 0, 0
+	if v := settings["BusinessDayStart"]; v != "" {
+		t, err := time.Parse("15:04", v)
+		if err != nil {
+			return errors.New("BusinessDayStartが不正です:" + v)
+		}
+		businessDayHour, businessDayMinute = t.Hour(), t.Minute()
+	}
+	return nil
+}
+
+type stageState struct {
+	stage     metricStage
+	surveyed  map[string]bool
+	durations []float64
+}
+
+// tが属する営業日の開始時刻
+func businessDayStart(t time.Time) time.Time {
+	t = t.Local()
+	start := time.Date(t.Year(), t.Month(), t.Day(), businessDayHour, businessDayMinute, 0, 0, time.Local)
+	if t.Before(start) {
+		start = start.AddDate(0, 0, -1)
+	}
+	return start
+}
+
+// 営業日は開始した日付(YYYYMMDD)で表す
+func businessDayKey(t time.Time) string {
+	return businessDayStart(t).Format("20060102")
+}
+
+func parseBusinessDay(day string) (time.Time, error) {
+	d, err := time.ParseInLocation("20060102", day, time.Local)
+	if err != nil {
+		return d, errors.New("日付はYYYYMMDDで指定してください:" + day)
+	}
+	return time.Date(d.Year(), d.Month(), d.Day(), businessDayHour, businessDayMinute, 0, 0, time.Local), nil
+}
+
+// 終了ステータスになった記録と所要時間(分)
+type stageTransition struct {
+	Awbno   string
+	Minutes float64
+	End     StsDoc
+}
+
+// 区間の集計に使う履歴。開始ステータスになった時刻が前の営業日でも集計できるように遡って検索する
+// 全ての区間で同じ履歴を使うため、集計ごとに1回だけ検索する
+func stageHistories(awbs []string, from, to int64) (map[string][]StsDoc, error) {
+	return stsStore.HistoryMany(awbs, from-carryForwardWindow, to)
+}
+
+// from <= 終了ステータスになった時刻 < to のAWBの遷移
+func stageTransitions(histories map[string][]StsDoc, awbs []string, stage metricStage, from, to int64) []stageTransition {
+	result := make([]stageTransition, 0, len(awbs))
+	for _, awb := range awbs {
+		start, end, ok := findTransition(histories[awb], stage.From, stage.To)
+		if !ok || end.UpdateTime < from || end.UpdateTime >= to {
+			continue
+		}
+		result = append(result, stageTransition{Awbno: awb, Minutes: float64(end.UpdateTime-start.UpdateTime) / float64(60*1000), End: end})
+	}
+	return result
+}
+
+// from <= 終了ステータスになった時刻 < to のAWBの所要時間(分)と、そのAWB
+func stageDurations(histories map[string][]StsDoc, awbs []string, stage metricStage, from, to int64) ([]float64, map[string]bool) {
+	transitions := stageTransitions(histories, awbs, stage, from, to)
+	reached := make(map[string]bool, len(transitions))
+	durs := make([]float64, 0, len(transitions))
+	for _, tr := range transitions {
+		durs = append(durs, tr.Minutes)
+		reached[tr.Awbno] = true
+	}
+	return durs, reached
+}
+
+// 営業日の集計を格納先の記録から作り直す
+func loadDayStages(day string) ([]*stageState, error) {
+	start, err := parseBusinessDay(day)
+	if err != nil {
+		return nil, err
+	}
+	from := start.UnixMilli()
+	to := start.AddDate(0, 0, 1).UnixMilli()
+	if now := time.Now().UnixMilli(); to > now {
+		to = now + 1
+	}
+	awbs, err := awbsBetween(from, to)
+	if err != nil {
+		return nil, err
+	}
+	histories, err := stageHistories(awbs, from, to)
+	if err != nil {
+		return nil, err
+	}
+	stages := make([]*stageState, 0, len(metricStages))
+	for _, stage := range metricStages {
+		durs, reached := stageDurations(histories, awbs, stage, from, to)
+		stages = append(stages, &stageState{stage: stage, surveyed: reached, durations: durs})
+	}
+	return stages, nil
+}
+
+// 期間内に記録があるAWB。終了ステータスへの変更は期間内に記録されている
+func awbsBetween(from, to int64) ([]string, error) {
+	docs, err := stsStore.Latest(from, to)
+	if err != nil {
+		return nil, err
+	}
+	awbs := make([]string, 0, len(docs))
+	for _, doc := range docs {
+		awbs = append(awbs, doc.Awbno)
+	}
+	return awbs, nil
+}
+
+func emptyStages() []*stageState {
+	stages := make([]*stageState, 0, len(metricStages))
+	for _, stage := range metricStages {
+		stages = append(stages, &stageState{stage: stage, surveyed: make(map[string]bool)})
+	}
+	return stages
+}
+
+// 当日(営業日)分は取り込みのgoroutineから更新し、APIから参照する
+type metricsCollector struct {
+	mu     sync.Mutex
+	day    string
+	stages []*stageState
+	//終わった営業日の集計
+	past map[string]Metrics
+}
+
+// 起動時は当日分を格納先から集計し直す
+func newMetricsCollector() *metricsCollector {
+	c := &metricsCollector{past: make(map[string]Metrics)}
+	c.reset(businessDayKey(time.Now()))
+	return c
+}
+
+func (c *metricsCollector) reset(day string) {
+	stages, err := loadDayStages(day)
+	if err != nil {
+		log.Printf("集計を作り直せません。0から集計します:%s %s", day, err)
+		stages = emptyStages()
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.day = day
+	c.stages = stages
+}
+
+// 終了ステータスに達したAWBの所要時間を1度だけ集計する
+func (c *metricsCollector) update(result []AwbStatus) {
+	now := time.Now()
+	if day := businessDayKey(now); day != c.day {
+		log.Printf("営業日が変わりました。集計をやり直します:%s", day)
+		c.reset(day)
+	}
+	from := businessDayStart(now).UnixMilli()
+	to := now.UnixMilli() + 1
+	for _, st := range c.stages {
+		survayAwbs := make([]string, 0, 100)
+		for _, status := range result {
+			if st.surveyed[status.Awbno] {
+				continue
+			}
+			if statusBefore(status.StatusCode, st.stage.To) {
+				continue
+			}
+			survayAwbs = append(survayAwbs, status.Awbno)
+		}
+		if len(survayAwbs) < 1 {
+			continue
+		}
+		//取得できなかった場合は次の取り込みで改めて集計する
+		histories, err := stageHistories(survayAwbs, from, to)
+		if err != nil {
+			log.Printf("%s", err)
+			continue
+		}
+		durs, _ := stageDurations(histories, survayAwbs, st.stage, from, to)
+		c.mu.Lock()
+		st.durations = append(st.durations, durs...)
+		c.mu.Unlock()
+		for _, awb := range survayAwbs {
+			st.surveyed[awb] = true
+		}
+	}
+}
+
+func (c *metricsCollector) snapshot() Metrics {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return summarizeStages(c.day, c.stages)
+}
+
+// 過去の営業日は格納先から集計する。終わった営業日の結果は保持しておく
+func (c *metricsCollector) dayMetrics(day string) (Metrics, error) {
+	c.mu.Lock()
+	if day == c.day {
+		c.mu.Unlock()
+		return c.snapshot(), nil
+	}
+	met, ok := c.past[day]
+	c.mu.Unlock()
+	if ok {
+		return met, nil
+	}
+	start, err := parseBusinessDay(day)
+	if err != nil {
+		return Metrics{}, err
+	}
+	stages, err := loadDayStages(day)
+	if err != nil {
+		return Metrics{}, err
+	}
+	met = summarizeStages(day, stages)
+	if time.Now().After(start.AddDate(0, 0, 1)) {
+		c.mu.Lock()
+		c.past[day] = met
+		c.mu.Unlock()
+	}
+	return met, nil
+}
+
+func summarizeStages(day string, stages []*stageState) Metrics {
+	met := Metrics{Day: day, Stages: make([]StageMetrics, 0, len(stages))}
+	for _, st := range stages {
+		sm := summarizeDurations(st.durations)
+		sm.metricStage = st.stage
+		switch st.stage.Name {
+		case "saku":
+			met.SakuAccumMins, met.SakuAccumCnts = sm.Total, sm.Count
+		case "shin":
+			met.ShinAccumMins, met.ShinAccumCnts = sm.Total, sm.Count
+		}
+		met.Stages = append(met.Stages, sm)
+	}
+	return met
+}
+
+func summarizeDurations(durations []float64) StageMetrics {
+	sm := StageMetrics{Count: int64(len(durations))}
+	if len(durations) < 1 {
+		return sm
+	}
+	sorted := append([]float64(nil), durations...)
+	sort.Float64s(sorted)
+	for _, d := range sorted {
+		sm.Total += d
+	}
+	sm.Mean = sm.Total / float64(len(sorted))
+	if n := len(sorted); n%2 == 1 {
+		sm.Median = sorted[n/2]
+	} else {
+		sm.Median = (sorted[n/2-1] + sorted[n/2]) / 2
+	}
+	//最近順位法
+	sm.P90 = sorted[int(math.Ceil(0.9*float64(len(sorted))))-1]
+	return sm
+}
+
+// day=YYYYMMDDを指定した場合はその営業日の集計
+func metricsApi(c echo.Context, met *metricsCollector) error {
+	if day := c.QueryParam("day"); day != "" {
+		start, err := parseBusinessDay(day)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, ErrorResponce{Error: err.Error()})
+		}
+		if start.After(time.Now()) {
+			return c.JSON(http.StatusBadRequest, ErrorResponce{Error: "未来の日付は指定できません:" + day})
+		}
+		result, err := met.dayMetrics(day)
+		if err != nil {
+			log.Printf("%s", err)
+			return c.JSON(http.StatusInternalServerError, ErrorResponce{Error: err.Error()})
+		}
+		return c.JSON(http.StatusOK, result)
+	}
+	return c.JSON(http.StatusOK, met.snapshot())
+}
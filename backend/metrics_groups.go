@@ -0,0 +1,122 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/labstack/echo"
+)
+
+// 1回に集計できる期間の上限
+const maxGroupMetricsDays = 31
+
+type GroupMetrics struct {
+	Key    string  `json:"key"`
+	Name   string  `json:"name"`
+	Count  int64   `json:"count"`
+	Total  float64 `json:"total"`
+	Mean   float64 `json:"mean"`
+	Median float64 `json:"median"`
+	P90    float64 `json:"p90"`
+}
+
+type StageGroupMetrics struct {
+	metricStage
+	Groups []GroupMetrics `json:"groups"`
+}
+
+type GroupMetricsResponce struct {
+	GroupBy string              `json:"group_by"`
+	From    int64               `json:"from"`
+	To      int64               `json:"to"`
+	Stages  []StageGroupMetrics `json:"stages"`
+}
+
+// 終了ステータスになった記録の会社・部署・更新者で分ける
+func groupKey(groupBy string, doc StsDoc) (key, name string) {
+	switch groupBy {
+	case "company":
+		return doc.CompanyCode, doc.CompanyName
+	case "section":
+		return doc.SectionCode, doc.SectionCode
+	}
+	return doc.LastUserId, doc.LastUserName
+}
+
+func groupTransitions(groupBy string, transitions []stageTransition) []GroupMetrics {
+	durations := make(map[string][]float64)
+	names := make(map[string]string)
+	for _, tr := range transitions {
+		key, name := groupKey(groupBy, tr.End)
+		durations[key] = append(durations[key], tr.Minutes)
+		names[key] = name
+	}
+	result := make([]GroupMetrics, 0, len(durations))
+	for key, durs := range durations {
+		sm := summarizeDurations(durs)
+		result = append(result, GroupMetrics{
+			Key:    key,
+			Name:   names[key],
+			Count:  sm.Count,
+			Total:  sm.Total,
+			Mean:   sm.Mean,
+			Median: sm.Median,
+			P90:    sm.P90,
+		})
+	}
+	//平均が長い順
+	sort.SliceStable(result, func(i, j int) bool {
+		if result[i].Mean != result[j].Mean {
+			return result[i].Mean > result[j].Mean
+		}
+		return result[i].Key < result[j].Key
+	})
+	return result
+}
+
+// group_by=company|section|user、from,to(UnixTime millsec)、stage=区間の名前(省略時は全て)
+func groupMetricsApi(c echo.Context) error {
+	groupBy := c.QueryParam("group_by")
+	if groupBy != "company" && groupBy != "section" && groupBy != "user" {
+		return c.JSON(http.StatusBadRequest, ErrorResponce{Error: "group_byはcompany,section,userのいずれかを指定してください"})
+	}
+	from, err := strconv.ParseInt(c.QueryParam("from"), 10, 64)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorResponce{Error: "fromが不正です"})
+	}
+	to, err := strconv.ParseInt(c.QueryParam("to"), 10, 64)
+	if err != nil || to <= from {
+		return c.JSON(http.StatusBadRequest, ErrorResponce{Error: "toが不正です"})
+	}
+	if to-from > maxGroupMetricsDays*24*60*60*1000 {
+		return c.JSON(http.StatusBadRequest, ErrorResponce{Error: "期間は" + strconv.Itoa(maxGroupMetricsDays) + "日以内で指定してください"})
+	}
+	stages := make([]metricStage, 0, len(metricStages))
+	for _, stage := range metricStages {
+		if c.QueryParam("stage") == "" || c.QueryParam("stage") == stage.Name {
+			stages = append(stages, stage)
+		}
+	}
+	if len(stages) < 1 {
+		return c.JSON(http.StatusBadRequest, ErrorResponce{Error: "stageが見つかりません:" + c.QueryParam("stage")})
+	}
+
+	awbs, err := awbsBetween(from, to)
+	if err != nil {
+		log.Printf("%s", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponce{Error: err.Error()})
+	}
+	histories, err := stageHistories(awbs, from, to)
+	if err != nil {
+		log.Printf("%s", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponce{Error: err.Error()})
+	}
+	result := GroupMetricsResponce{GroupBy: groupBy, From: from, To: to, Stages: make([]StageGroupMetrics, 0, len(stages))}
+	for _, stage := range stages {
+		transitions := stageTransitions(histories, awbs, stage, from, to)
+		result.Stages = append(result.Stages, StageGroupMetrics{metricStage: stage, Groups: groupTransitions(groupBy, transitions)})
+	}
+	return c.JSON(http.StatusOK, result)
+}
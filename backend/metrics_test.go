@@ -0,0 +1,22 @@
+package main
+
+import "testing"
+
+func TestSummarizeDurations(t *testing.T) {
+	if sm := summarizeDurations(nil); sm.Count != 0 || sm.Total != 0 || sm.P90 != 0 {
+		t.Fatalf("空の集計が違います:%+v", sm)
+	}
+	sm := summarizeDurations([]float64{30, 10, 20})
+	if sm.Count != 3 || sm.Total != 60 || sm.Mean != 20 || sm.Median != 20 || sm.P90 != 30 {
+		t.Fatalf("奇数件の集計が違います:%+v", sm)
+	}
+	//偶数件の中央値は中央の2件の平均。P90は最近順位法
+	durations := []float64{10, 1, 9, 2, 8, 3, 7, 4, 6, 5}
+	sm = summarizeDurations(durations)
+	if sm.Count != 10 || sm.Total != 55 || sm.Mean != 5.5 || sm.Median != 5.5 || sm.P90 != 9 {
+		t.Fatalf("偶数件の集計が違います:%+v", sm)
+	}
+	if durations[0] != 10 {
+		t.Fatal("渡した値を並べ替えています")
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/labstack/echo"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// /metricsはPrometheusのテキスト形式で出力する。登録先はこのアプリ専用のレジストリにする
+var promRegistry = prometheus.NewRegistry()
+var promFactory = promauto.With(promRegistry)
+
+var promIngestDuration = promFactory.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "stschecker_ingest_duration_seconds",
+	Help:    "取り込み1回の処理時間",
+	Buckets: []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60},
+}, []string{"source"})
+var promIngestTotal = promFactory.NewCounterVec(prometheus.CounterOpts{
+	Name: "stschecker_ingest_total",
+	Help: "取り込みの実行回数",
+}, []string{"source", "result"})
+var promRowsParsed = promFactory.NewCounterVec(prometheus.CounterOpts{
+	Name: "stschecker_rows_parsed_total",
+	Help: "読み込んだ行数",
+}, []string{"source"})
+var promLockWait = promFactory.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "stschecker_lock_wait_seconds",
+	Help:    "ロックファイルの取得を待った時間",
+	Buckets: []float64{0, 1, 2, 5, 10, 20, 30, 60},
+}, []string{"lock"})
+var promLockForced = promFactory.NewCounterVec(prometheus.CounterOpts{
+	Name: "stschecker_lock_forced_removals_total",
+	Help: "ロックファイルを強制削除した回数",
+}, []string{"lock"})
+var promHttpDuration = promFactory.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "stschecker_http_request_duration_seconds",
+	Help:    "APIの応答時間",
+	Buckets: []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10},
+}, []string{"method", "route", "code"})
+
+// 格納先への登録件数は/api/store/statsと同じ値を出力する
+var _ = promFactory.NewCounterFunc(prometheus.CounterOpts{
+	Name: "stschecker_store_indexed_total",
+	Help: "格納先に登録した件数",
+}, func() float64 { return float64(atomic.LoadUint64(&storeIndexed)) })
+var _ = promFactory.NewCounterFunc(prometheus.CounterOpts{
+	Name: "stschecker_store_failed_total",
+	Help: "格納先への登録に失敗した件数",
+}, func() float64 { return float64(atomic.LoadUint64(&storeFailed)) })
+var _ = promFactory.NewCounterFunc(prometheus.CounterOpts{
+	Name: "stschecker_store_requests_total",
+	Help: "格納先への登録リクエスト数",
+}, func() float64 { return float64(atomic.LoadUint64(&storeRequests)) })
+
+// 取り込みの状態、スナップショット、アラートは出力する時点の値を集める
+type promStateCollector struct{}
+
+var (
+	promLastSuccessDesc = prometheus.NewDesc("stschecker_last_success_timestamp_seconds", "最後に取り込みに成功した時刻(UnixTime)", []string{"source"}, nil)
+	promFailuresDesc    = prometheus.NewDesc("stschecker_ingest_consecutive_failures", "取り込みの連続失敗回数", []string{"source"}, nil)
+	promAwbsDesc        = prometheus.NewDesc("stschecker_awbs", "ステータスごとのAWB数", []string{"status"}, nil)
+	promAlertsDesc      = prometheus.NewDesc("stschecker_alerts_active", "ルールごとの発生中のアラート数", []string{"rule"}, nil)
+	promVersionDesc     = prometheus.NewDesc("stschecker_snapshot_version", "現在のスナップショットの版", nil, nil)
+)
+
+func (promStateCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- promLastSuccessDesc
+	ch <- promFailuresDesc
+	ch <- promAwbsDesc
+	ch <- promAlertsDesc
+	ch <- promVersionDesc
+}
+
+func (promStateCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, src := range ingestErrors.list() {
+		if src.LastSuccessTime != nil {
+			ch <- prometheus.MustNewConstMetric(promLastSuccessDesc, prometheus.GaugeValue, float64(src.LastSuccessTime.UnixMilli())/1000, src.Source)
+		}
+		ch <- prometheus.MustNewConstMetric(promFailuresDesc, prometheus.GaugeValue, float64(src.ConsecutiveFailures), src.Source)
+	}
+
+	snap := currentSnapshot()
+	awbs := make(map[string]float64)
+	for _, awb := range snap.Awbs {
+		awbs[awb.StatusCode]++
+	}
+	for status, n := range awbs {
+		ch <- prometheus.MustNewConstMetric(promAwbsDesc, prometheus.GaugeValue, n, status)
+	}
+	active := make(map[string]float64)
+	for _, rule := range alertRules {
+		active[rule.Name] = 0
+	}
+	for _, a := range alerts.list() {
+		active[a.Rule]++
+	}
+	for rule, n := range active {
+		ch <- prometheus.MustNewConstMetric(promAlertsDesc, prometheus.GaugeValue, n, rule)
+	}
+	ch <- prometheus.MustNewConstMetric(promVersionDesc, prometheus.GaugeValue, float64(snap.Version))
+}
+
+func init() {
+	promRegistry.MustRegister(promStateCollector{})
+}
+
+// ルートごとの応答時間を記録する。ルートは登録したパス(/api/awb/:awbno/historyなど)
+func promHttpMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		start := time.Now()
+		err := next(c)
+		if err != nil {
+			c.Error(err)
+		}
+		promHttpDuration.WithLabelValues(c.Request().Method, c.Path(), strconv.Itoa(c.Response().Status)).Observe(time.Since(start).Seconds())
+		return nil
+	}
+}
+
+var promMetricsApi = echo.WrapHandler(promhttp.HandlerFor(promRegistry, promhttp.HandlerOpts{}))
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestPromMetricsApi(t *testing.T) {
+	promIngestTotal.WithLabelValues("sts", "success").Inc()
+	promHttpDuration.WithLabelValues("GET", "/api/awb", "200").Observe(0.02)
+	swapSnapshot(map[string]AwbStatus{"1": {Awbno: "1", StatusCode: "50"}, "2": {Awbno: "2", StatusCode: "50"}})
+	defer swapSnapshot(map[string]AwbStatus{})
+
+	c, rec := newTestContext(http.MethodGet, "/metrics")
+	if err := promMetricsApi(c); err != nil {
+		t.Fatal(err)
+	}
+	body := rec.Body.String()
+	for _, want := range []string{
+		"# TYPE stschecker_ingest_total counter",
+		`stschecker_ingest_total{result="success",source="sts"} 1`,
+		`stschecker_http_request_duration_seconds_bucket{code="200",method="GET",route="/api/awb",le="0.025"} 1`,
+		"# TYPE stschecker_store_indexed_total counter",
+		`stschecker_awbs{status="50"} 2`,
+		"stschecker_snapshot_version ",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("出力に%sがありません", want)
+		}
+	}
+	if t.Failed() {
+		t.Log(body)
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// 取り込み1回分の現在のステータス。作成後は変更せず、取り込みごとに丸ごと差し替える
+type Snapshot struct {
+	Version int64
+	Time    time.Time
+	Awbs    map[string]AwbStatus
+}
+
+var snapshots atomic.Value
+
+func init() {
+	snapshots.Store(&Snapshot{Version: 0, Time: time.Now(), Awbs: make(map[string]AwbStatus)})
+}
+
+func currentSnapshot() *Snapshot {
+	return snapshots.Load().(*Snapshot)
+}
+
+// 差し替えは取り込みのgoroutineからのみ行う
+func swapSnapshot(awbs map[string]AwbStatus) *Snapshot {
+	snap := &Snapshot{Version: currentSnapshot().Version + 1, Time: time.Now(), Awbs: awbs}
+	snapshots.Store(snap)
+	return snap
+}
+
+func (s *Snapshot) versionHeader() string {
+	return strconv.FormatInt(s.Version, 10)
+}
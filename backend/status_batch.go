@@ -0,0 +1,65 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo"
+)
+
+// 1回のリクエストで指定できるAWBの数
+const maxBatchStatusKeys = 500
+
+// from,toはUnixTime(millsec)。islatest,isupdateは/api/statusと同じ
+type BatchStatusRequest struct {
+	Keys     []string `json:"keys"`
+	From     int64    `json:"from"`
+	To       int64    `json:"to"`
+	IsLatest bool     `json:"islatest"`
+	IsUpdate bool     `json:"isupdate"`
+}
+
+type BatchStatus struct {
+	Key    string   `json:"key"`
+	Status []Status `json:"status"`
+}
+
+type BatchStatusResponce struct {
+	Results []BatchStatus `json:"results"`
+}
+
+// 複数のAWBのステータスをまとめて返す。結果はkeysと同じ順
+func statusBatchApi(c echo.Context, s StatusStore) error {
+	var req BatchStatusRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorResponce{Error: err.Error()})
+	}
+	if len(req.Keys) < 1 || req.From <= 0 || req.To <= req.From {
+		return c.JSON(http.StatusBadRequest, ErrorResponce{Error: "keys,from,toを指定してください"})
+	}
+	if len(req.Keys) > maxBatchStatusKeys {
+		return c.JSON(http.StatusBadRequest, ErrorResponce{Error: "keysは" + strconv.Itoa(maxBatchStatusKeys) + "件までです"})
+	}
+	awbnos := make([]string, 0, len(req.Keys))
+	for _, key := range req.Keys {
+		awbno, err := normalizeAwbKey(key)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, ErrorResponce{Error: err.Error()})
+		}
+		awbnos = append(awbnos, awbno)
+	}
+	carried, histories, err := historiesWithCarry(s, awbnos, req.From, req.To)
+	if err != nil {
+		log.Printf("%s", err)
+		return c.JSON(http.StatusInternalServerError, ErrorResponce{Error: err.Error()})
+	}
+	result := BatchStatusResponce{Results: make([]BatchStatus, 0, len(awbnos))}
+	for i, awbno := range awbnos {
+		result.Results = append(result.Results, BatchStatus{
+			Key:    req.Keys[i],
+			Status: awbTimeline(carried[awbno], histories[awbno], req.From, req.To, awbno, 10, req.IsLatest, req.IsUpdate),
+		})
+	}
+	return c.JSON(http.StatusOK, result)
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo"
+)
+
+// StatusCatalog.<ステータス>=日本語名,英語名,色,順序,区分,終了(true/false) で指定する
+const statusCatalogPrefix = "StatusCatalog."
+
+type StatusDef struct {
+	Code     string `json:"code"`
+	Label    string `json:"label"`
+	LabelEn  string `json:"label_en"`
+	Color    string `json:"color"`
+	Order    int    `json:"order"`
+	Category string `json:"category"`
+	Terminal bool   `json:"terminal"`
+}
+
+var statusCatalog map[string]StatusDef
+var sts75Status string
+
+// 順序を省略した場合や一覧にないステータスは数値として並べる。数値でなければ最後
+func statusOrder(code string) int {
+	if def, ok := statusCatalog[code]; ok {
+		return def.Order
+	}
+	if n, err := strconv.Atoi(code); err == nil {
+		return n
+	}
+	return math.MaxInt32
+}
+
+func loadStatusCatalogSettings(settings map[string]string) error {
+	statusCatalog = make(map[string]StatusDef)
+	for k, v := range settings {
+		if !strings.HasPrefix(k, statusCatalogPrefix) || len(k) <= len(statusCatalogPrefix) {
+			continue
+		}
+		code := strings.TrimPrefix(k, statusCatalogPrefix)
+		parts := strings.Split(v, ",")
+		for len(parts) < 6 {
+			parts = append(parts, "")
+		}
+		def := StatusDef{Code: code, Label: parts[0], LabelEn: parts[1], Color: parts[2], Category: parts[4]}
+		if def.Label == "" {
+			def.Label = code
+		}
+		if def.LabelEn == "" {
+			def.LabelEn = def.Label
+		}
+		if parts[3] != "" {
+			n, err := strconv.Atoi(parts[3])
+			if err != nil {
+				return errors.New(k + "の順序が不正です:" + parts[3])
+			}
+			def.Order = n
+		} else if n, err := strconv.Atoi(code); err == nil {
+			def.Order = n
+		} else {
+			return errors.New(k + "の順序が指定されていません")
+		}
+		switch parts[5] {
+		case "", "false":
+		case "true":
+			def.Terminal = true
+		default:
+			return errors.New(k + "の終了はtrueかfalseを指定してください:" + parts[5])
+		}
+		statusCatalog[code] = def
+	}
+	//STS75Status=75リストに書き出すステータス
+	sts75Status = settings["STS75Status"]
+	if sts75Status == "" {
+		sts75Status = "75"
+	}
+	return nil
+}
+
+// aがbより前なら負、後なら正。順序が同じなら文字列で比べる
+func compareStatus(a, b string) int {
+	oa, ob := statusOrder(a), statusOrder(b)
+	switch {
+	case oa < ob:
+		return -1
+	case oa > ob:
+		return 1
+	}
+	return strings.Compare(a, b)
+}
+
+func statusBefore(a, b string) bool {
+	return compareStatus(a, b) < 0
+}
+
+func isTerminalStatus(code string) bool {
+	return statusCatalog[code].Terminal
+}
+
+func statusDef(code string) StatusDef {
+	if def, ok := statusCatalog[code]; ok {
+		return def
+	}
+	return StatusDef{Code: code, Label: code, LabelEn: code, Order: statusOrder(code)}
+}
+
+// statuscodesは現在のステータスの一覧(画面の互換のため)。catalogは設定したステータスと現在のステータスの定義
+func stslistApi(c echo.Context, snap *Snapshot) error {
+	stsTable := make(map[string]bool)
+	for _, value := range snap.Awbs {
+		stsTable[value.StatusCode] = true
+	}
+
+	result := StslistResponce{StatusCode: make([]string, 0, 100), Catalog: make([]StatusDef, 0, len(statusCatalog)+len(stsTable)), Version: snap.Version}
+	for s := range stsTable {
+		result.StatusCode = append(result.StatusCode, s)
+	}
+	sort.SliceStable(result.StatusCode, func(i, j int) bool { return statusBefore(result.StatusCode[i], result.StatusCode[j]) })
+	for code := range statusCatalog {
+		result.Catalog = append(result.Catalog, statusCatalog[code])
+	}
+	for s := range stsTable {
+		if _, ok := statusCatalog[s]; !ok {
+			result.Catalog = append(result.Catalog, statusDef(s))
+		}
+	}
+	sort.SliceStable(result.Catalog, func(i, j int) bool { return statusBefore(result.Catalog[i].Code, result.Catalog[j].Code) })
+	return c.JSON(http.StatusOK, result)
+}
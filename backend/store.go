@@ -0,0 +1,243 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+var stsStore StatusStore
+var storeType string
+
+// 格納先への登録件数(起動してからの累計)
+type StoreStats struct {
+	Type     string `json:"type"`
+	Indexed  uint64 `json:"indexed"`
+	Failed   uint64 `json:"failed"`
+	Requests uint64 `json:"requests"`
+}
+
+var storeIndexed uint64
+var storeFailed uint64
+var storeRequests uint64
+
+func countStored(indexed, failed, requests uint64) {
+	atomic.AddUint64(&storeIndexed, indexed)
+	atomic.AddUint64(&storeFailed, failed)
+	atomic.AddUint64(&storeRequests, requests)
+}
+
+func storeStatsApi(c echo.Context) error {
+	kind := storeType
+	if kind == "" {
+		kind = "elasticsearch"
+	}
+	return c.JSON(http.StatusOK, StoreStats{
+		Type:     kind,
+		Indexed:  atomic.LoadUint64(&storeIndexed),
+		Failed:   atomic.LoadUint64(&storeFailed),
+		Requests: atomic.LoadUint64(&storeRequests),
+	})
+}
+
+// sts_index_YYYYMMDDに格納される1件分のステータス
+type StsDoc struct {
+	Awbno        string `json:"awb_no"`
+	UpdateTime   int64  `json:"update_time"`
+	StatusCode   string `json:"sts_code"`
+	LastUserName string `json:"last_updated_user"`
+	LastUserId   string `json:"last_updated_user_id"`
+	CompanyName  string `json:"company_name"`
+	CompanyCode  string `json:"company_code"`
+	SectionCode  string `json:"section_code"`
+	IsStocked    bool   `json:"is_stocked"`
+	IgsStatus    string `json:"igs_status"`
+	Event        string `json:"event"`
+}
+
+// 同じ記録を2回登録しないためのキー。AWBごとに同じ時刻・同じ種類の記録は1件だけ
+func stsDocKey(doc StsDoc) string {
+	return doc.Awbno + "_" + strconv.FormatInt(doc.UpdateTime, 10) + "_" + doc.Event
+}
+
+// ステータスの格納先。from,toはUnixTime(millsec)
+type StatusStore interface {
+	// 当日分の格納先を用意する
+	Prepare() error
+	// 取り込んだスナップショットを追加する
+	Append(docs []StsDoc) error
+	// AWBの履歴をupdate_timeの昇順で返す(from <= update_time <= to)
+	History(awbno string, from, to int64) ([]StsDoc, error)
+	// 複数のAWBの履歴をまとめて返す。戻り値はAWB番号ごと
+	HistoryMany(awbnos []string, from, to int64) (map[string][]StsDoc, error)
+	// 期間内(from <= update_time < to)のAWBごとの最新ステータスを返す
+	Latest(from, to int64) ([]StsDoc, error)
+	// 指定したAWBごとに期間内(from <= update_time < to)の最後の記録を返す。記録がないAWBは含めない
+	LatestOf(awbnos []string, from, to int64) (map[string]StsDoc, error)
+	// days日より前の日付の分をアーカイブしてから削除する
+	Purge(days int) error
+	// 格納されている日(YYYYMMDD)の一覧
+	Days() ([]string, error)
+	// 指定した日の全件を順に渡す
+	EachDoc(day string, fn func(StsDoc) error) error
+	// 指定した日の分を削除する
+	DropDay(day string) error
+}
+
+func newStatusStore(kind string) (StatusStore, error) {
+	switch kind {
+	case "", "elasticsearch":
+		return newEsStore()
+	case "file":
+		return newFileStore(storeFolderPath)
+	case "memory":
+		return newMemStore(), nil
+	}
+	return nil, errors.New("StoreTypeが不正です:" + kind)
+}
+
+// AWBごとにHistoryを呼ぶ。まとめて検索できない格納先で使う
+func historyEach(s StatusStore, awbnos []string, from, to int64) (map[string][]StsDoc, error) {
+	result := make(map[string][]StsDoc, len(awbnos))
+	for _, awbno := range awbnos {
+		docs, err := s.History(awbno, from, to)
+		if err != nil {
+			return nil, err
+		}
+		result[awbno] = docs
+	}
+	return result, nil
+}
+
+// gte未満⇒gte以上⇒lt以上と遷移した場合に、gte以上になった記録とlt以上になった記録を返す
+// 削除の記録は遷移として扱わない
+func findTransition(docs []StsDoc, gte, lt string) (start, end StsDoc, ok bool) {
+	kept := make([]StsDoc, 0, len(docs))
+	for _, doc := range docs {
+		if !isRemoved(doc) {
+			kept = append(kept, doc)
+		}
+	}
+	docs = kept
+	isOK := false
+	contidx := 0
+	for idx, doc := range docs {
+		if statusBefore(doc.StatusCode, gte) {
+			isOK = true
+			contidx = idx + 1
+			break
+		}
+	}
+	if !isOK {
+		return start, end, false
+	}
+	isOK = false
+	startidx := 0
+	for idx := contidx; idx < len(docs); idx++ {
+		if !statusBefore(docs[idx].StatusCode, gte) {
+			isOK = true
+			startidx = idx
+			contidx = idx + 1
+			break
+		}
+	}
+	if !isOK {
+		return start, end, false
+	}
+	isOK = false
+	endidx := 0
+	for idx := contidx; idx < len(docs); idx++ {
+		if !statusBefore(docs[idx].StatusCode, lt) {
+			isOK = true
+			endidx = idx
+			break
+		}
+	}
+	if !isOK {
+		return start, end, false
+	}
+	return docs[startidx], docs[endidx], true
+}
+
+// from,toを含む日(YYYYMMDD)の一覧
+func daysBetween(from, to int64) []string {
+	days := make([]string, 0, 2)
+	f := time.UnixMilli(from).Local()
+	c := time.Date(f.Year(), f.Month(), f.Day(), 0, 0, 0, 0, time.Local)
+	for !c.After(time.UnixMilli(to)) {
+		days = append(days, c.Format("20060102"))
+		c = c.AddDate(0, 0, 1)
+	}
+	return days
+}
+
+// YYYYMMDD形式の日付が保存期間(days日)を過ぎているか
+func isExpiredDay(day string, days int) bool {
+	t, err := time.ParseInLocation("20060102", day, time.Local)
+	if err != nil {
+		return false
+	}
+	y, m, d := time.Now().Date()
+	return t.Before(time.Date(y, m, d-days, 0, 0, 0, 0, time.Local))
+}
+
+// 保存期間を過ぎた日をアーカイブしてから削除する。アーカイブに失敗した日は削除しない
+// ArchiveFolderPathが未設定の場合は日ごとに警告を出してアーカイブせずに削除する
+func purgeExpired(s StatusStore, days int) error {
+	stored, err := s.Days()
+	if err != nil {
+		return err
+	}
+	imported, err := loadImportedDays()
+	if err != nil {
+		log.Printf("取り込んだ日の一覧を読み込めません:%s", err)
+		imported = make(map[string]time.Time)
+	}
+	dropped := false
+	for _, day := range stored {
+		if !isExpiredDay(day, days) {
+			continue
+		}
+		//アーカイブから取り込んだ日は取り込んでからImportKeepDays日は残す
+		if at, ok := imported[day]; ok && time.Since(at) < time.Duration(importKeepDays)*24*time.Hour {
+			continue
+		}
+		if archiveFolderPath == "" {
+			log.Printf("ArchiveFolderPathが設定されていないため、アーカイブせずに削除します:%s", day)
+		} else if err := archiveDay(s, day); err != nil {
+			log.Printf("アーカイブに失敗したため削除しません:%s %s", day, err)
+			continue
+		}
+		if err := s.DropDay(day); err != nil {
+			return err
+		}
+		if _, ok := imported[day]; ok {
+			delete(imported, day)
+			dropped = true
+		}
+	}
+	if dropped {
+		return saveImportedDays(imported)
+	}
+	return nil
+}
+
+// 日付が変わったら当日分の格納先を用意し、保存期間を過ぎた分を削除する
+func rolloverDaily(deleteFrom int) {
+	for {
+		now := time.Now()
+		time.Sleep(time.Until(time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.Local)))
+		log.Printf("日付が変わりました。格納先を切り替えます")
+		if err := stsStore.Prepare(); err != nil {
+			log.Printf("%s", err)
+		}
+		if err := stsStore.Purge(deleteFrom); err != nil {
+			log.Printf("%s", err)
+		}
+	}
+}
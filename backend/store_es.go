@@ -0,0 +1,588 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/elastic/go-elasticsearch/v7"
+	"github.com/elastic/go-elasticsearch/v7/esapi"
+	"github.com/elastic/go-elasticsearch/v7/esutil"
+)
+
+const esStsMapping = `{"mappings":{"properties":{"awb_no":{"type":"keyword","doc_values":true},"update_time":{"type":"date","doc_values":true},"sts_code":{"type":"keyword","doc_values":true},"last_updated_user":{"type":"keyword","doc_values":true},"last_updated_user_id":{"type":"keyword","doc_values":true},"company_name":{"type":"keyword","doc_values":true},"company_code":{"type":"keyword","doc_values":true},"section_code":{"type":"keyword","doc_values":true},"is_stocked":{"type":"boolean","doc_values":true},"igs_status":{"type":"keyword","doc_values":true},"event":{"type":"keyword","doc_values":true}}}}`
+
+var esAddresses []string
+var esUsername string
+var esPassword string
+var esAPIKey string
+var esCACertPath string
+var esIndexPrefix string
+var esBulkFlushBytes int
+var esBulkWorkers int
+
+type esStore struct {
+	es7     *elasticsearch.Client
+	mu      sync.Mutex
+	created map[string]bool
+}
+
+type esHit struct {
+	Source StsDoc            `json:"_source"`
+	Sort   []json.RawMessage `json:"sort"`
+}
+
+type esSearchResponse struct {
+	ScrollID string `json:"_scroll_id"`
+	Hits     struct {
+		Hits []esHit `json:"hits"`
+	} `json:"hits"`
+	Aggregations struct {
+		F struct {
+			Awbs struct {
+				Buckets []struct {
+					Key    string `json:"key"`
+					Latest struct {
+						Hits struct {
+							Hits []esHit `json:"hits"`
+						} `json:"hits"`
+					} `json:"latest"`
+				} `json:"buckets"`
+			} `json:"awbs"`
+			Page struct {
+				AfterKey json.RawMessage `json:"after_key"`
+				Buckets  []struct {
+					Latest struct {
+						Hits struct {
+							Hits []esHit `json:"hits"`
+						} `json:"hits"`
+					} `json:"latest"`
+				} `json:"buckets"`
+			} `json:"page"`
+		} `json:"f"`
+	} `json:"aggregations"`
+}
+
+func loadEsSettings(settings map[string]string) error {
+	esAddresses = make([]string, 0, 3)
+	for _, addr := range strings.Split(settings["ESAddresses"], ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			esAddresses = append(esAddresses, addr)
+		}
+	}
+	if len(esAddresses) < 1 {
+		esAddresses = append(esAddresses, "http://localhost:9200")
+	}
+	esUsername = settings["ESUsername"]
+	esPassword = settings["ESPassword"]
+	esAPIKey = settings["ESAPIKey"]
+	if esUsername != "" && esPassword == "" {
+		return errors.New("ESUsernameを指定する場合はESPasswordも設定してください")
+	}
+	esCACertPath = settings["ESCACertPath"]
+	esIndexPrefix = settings["ESIndexPrefix"]
+	if esIndexPrefix == "" {
+		esIndexPrefix = `sts_index_`
+	}
+	//一括登録の1リクエストあたりの上限バイト数
+	//登録はAppendごとに最後まで送信して結果を返すため、送信間隔は指定しない
+	esBulkFlushBytes = 1024 * 1024
+	if settings["ESBulkFlushBytes"] != "" {
+		b, err := strconv.Atoi(settings["ESBulkFlushBytes"])
+		if err != nil || b < 1 {
+			return errors.New("ESBulkFlushBytesが不正です:" + settings["ESBulkFlushBytes"])
+		}
+		esBulkFlushBytes = b
+	}
+	esBulkWorkers = 1
+	if settings["ESBulkWorkers"] != "" {
+		w, err := strconv.Atoi(settings["ESBulkWorkers"])
+		if err != nil || w < 1 {
+			return errors.New("ESBulkWorkersが不正です:" + settings["ESBulkWorkers"])
+		}
+		esBulkWorkers = w
+	}
+	return nil
+}
+
+// クライアントは起動時に1つだけ作成し、全ての処理で共有する
+func newEsStore() (*esStore, error) {
+	cfg := elasticsearch.Config{
+		Addresses: esAddresses,
+		Username:  esUsername,
+		Password:  esPassword,
+		APIKey:    esAPIKey,
+		Transport: &Tp,
+	}
+	if esCACertPath != "" {
+		cert, err := ioutil.ReadFile(esCACertPath)
+		if err != nil {
+			return nil, errors.New("ESCACertPathの証明書を読み込めません:" + err.Error())
+		}
+		cfg.CACert = cert
+	}
+
+	es7, err := elasticsearch.NewClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &esStore{es7: es7, created: make(map[string]bool)}, nil
+}
+
+func closeResponse(res *esapi.Response) {
+	if res != nil && res.Body != nil {
+		io.Copy(ioutil.Discard, res.Body)
+		res.Body.Close()
+	}
+}
+
+func esIndexName(t time.Time) string {
+	return esIndexPrefix + t.Local().Format("20060102")
+}
+
+// from,toを含む日毎のインデックス名
+// ワイルドカードで指定すると他の倉庫のプレフィックス(例:sts_index_b_)のインデックスまで対象になるため、
+// 期間が長い場合は存在する日のインデックスだけに絞る
+func (s *esStore) indicesBetween(from, to int64) ([]string, error) {
+	days := daysBetween(from, to)
+	if len(days) > 7 {
+		existing, err := s.Days()
+		if err != nil {
+			return nil, err
+		}
+		first, last := days[0], days[len(days)-1]
+		days = days[:0]
+		for _, day := range existing {
+			if day >= first && day <= last {
+				days = append(days, day)
+			}
+		}
+	}
+	if len(days) < 1 {
+		//インデックス未指定だと全インデックスが対象になるため開始日で補う
+		days = append(days, time.UnixMilli(from).Local().Format("20060102"))
+	}
+	indices := make([]string, 0, len(days))
+	for _, day := range days {
+		indices = append(indices, esIndexPrefix+day)
+	}
+	return indices, nil
+}
+
+func (s *esStore) search(indices []string, body esSearchBody, size int) (*esSearchResponse, error) {
+	ignoreUnavailable := true
+	allowNoIndices := true
+	rd, err := body.reader()
+	if err != nil {
+		return nil, err
+	}
+	req := esapi.SearchRequest{
+		Index:             indices,
+		Body:              rd,
+		Size:              &size,
+		IgnoreUnavailable: &ignoreUnavailable,
+		AllowNoIndices:    &allowNoIndices,
+	}
+	res, err := req.Do(context.Background(), s.es7.Transport)
+	if err != nil {
+		return nil, err
+	}
+	defer closeResponse(res)
+	if res.IsError() {
+		return nil, errors.New("検索に失敗しました " + res.String())
+	}
+	var r esSearchResponse
+	if err := json.NewDecoder(res.Body).Decode(&r); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// インデックスの存在確認⇒なければ作成
+func (s *esStore) ensureIndex(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.created[name] {
+		return nil
+	}
+	req := esapi.IndicesExistsRequest{
+		Index: []string{name},
+	}
+
+	res, err := req.Do(context.Background(), s.es7.Transport)
+	if err != nil {
+		return err
+	}
+	closeResponse(res)
+	//認証エラーなどで確認できない場合は作成済みとして扱わない
+	if res.StatusCode != 404 && res.IsError() {
+		return errors.New("インデックスの確認に失敗しました" + name + " " + res.Status())
+	}
+	if res.StatusCode == 404 {
+		req := esapi.IndicesCreateRequest{
+			Index: name,
+			Body:  strings.NewReader(esStsMapping),
+		}
+		res, err := req.Do(context.Background(), s.es7.Transport)
+		if err != nil {
+			return err
+		}
+		msg := res.String()
+		closeResponse(res)
+		//他のプロセスが先に作成した場合は作成済み
+		if res.IsError() && !strings.Contains(msg, "resource_already_exists_exception") {
+			return errors.New("インデックス作成に失敗しました" + name + " " + msg)
+		}
+	}
+	s.created[name] = true
+	return nil
+}
+
+func (s *esStore) Prepare() error {
+	return s.ensureIndex(esIndexName(time.Now()))
+}
+
+// 全件の登録が終わるまで待ち、失敗した件があればまとめてエラーにする
+func (s *esStore) Append(docs []StsDoc) error {
+	var mu sync.Mutex
+	failures := make([]string, 0, 10)
+	var failedCount int
+	addFailure := func(msg string) {
+		mu.Lock()
+		defer mu.Unlock()
+		failedCount++
+		//件数が多い場合は先頭の10件だけ残す
+		if len(failures) < 10 {
+			failures = append(failures, msg)
+		}
+	}
+	bi, err := esutil.NewBulkIndexer(esutil.BulkIndexerConfig{
+		Client:     s.es7,
+		NumWorkers: esBulkWorkers,
+		FlushBytes: esBulkFlushBytes,
+		OnError: func(ctx context.Context, err error) {
+			addFailure(err.Error())
+		},
+	})
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	for _, doc := range docs {
+		//日付を跨いだ場合もupdate_timeの日のインデックスへ登録する
+		idx := esIndexName(time.UnixMilli(doc.UpdateTime))
+		if err := s.ensureIndex(idx); err != nil {
+			bi.Close(ctx)
+			return err
+		}
+		body, err := json.Marshal(doc)
+		if err != nil {
+			bi.Close(ctx)
+			return err
+		}
+		awbno := doc.Awbno
+		//IDを記録の内容から決めるため、同じ記録を登録し直しても重複しない
+		err = bi.Add(ctx, esutil.BulkIndexerItem{
+			Index:      idx,
+			Action:     "index",
+			DocumentID: stsDocKey(doc),
+			Body:       bytes.NewReader(body),
+			OnFailure: func(ctx context.Context, item esutil.BulkIndexerItem, res esutil.BulkIndexerResponseItem, err error) {
+				if err != nil {
+					addFailure(awbno + ":" + err.Error())
+				} else {
+					addFailure(awbno + ":" + res.Error.Type + " " + res.Error.Reason)
+				}
+			},
+		})
+		if err != nil {
+			bi.Close(ctx)
+			return err
+		}
+	}
+	if err := bi.Close(ctx); err != nil {
+		return err
+	}
+	stats := bi.Stats()
+	countStored(stats.NumIndexed, stats.NumFailed, stats.NumRequests)
+	if failedCount > 0 {
+		return errors.New("データ登録に失敗 " + strconv.Itoa(failedCount) + "件/" + strconv.Itoa(len(docs)) + "件 " + strings.Join(failures, ", "))
+	}
+	return nil
+}
+
+// 1回の検索で取得する履歴の件数。超える分はsearch_afterで続きを取得する
+const esHistoryPageSize = 1000
+
+func (s *esStore) History(awbno string, from, to int64) ([]StsDoc, error) {
+	indices, err := s.indicesBetween(from, to)
+	if err != nil {
+		return nil, err
+	}
+	body := esSearchBody{
+		Sort:  esHistorySort(),
+		Query: esMust(esTerm("awb_no", awbno), esRange("update_time", from, to, true)),
+	}
+	result := make([]StsDoc, 0, 100)
+	for {
+		r, err := s.search(indices, body, esHistoryPageSize)
+		if err != nil {
+			return nil, err
+		}
+		for _, hit := range r.Hits.Hits {
+			result = append(result, hit.Source)
+		}
+		if len(r.Hits.Hits) < esHistoryPageSize {
+			return result, nil
+		}
+		body.SearchAfter = r.Hits.Hits[len(r.Hits.Hits)-1].Sort
+	}
+}
+
+// 1回のmsearchで検索するAWBの数
+const esMsearchChunk = 100
+
+func (s *esStore) HistoryMany(awbnos []string, from, to int64) (map[string][]StsDoc, error) {
+	result := make(map[string][]StsDoc, len(awbnos))
+	indices, err := s.indicesBetween(from, to)
+	if err != nil {
+		return nil, err
+	}
+	header := esMsearchHeader{Index: indices, IgnoreUnavailable: true, AllowNoIndices: true}
+	size := esHistoryPageSize
+	for start := 0; start < len(awbnos); start += esMsearchChunk {
+		end := start + esMsearchChunk
+		if end > len(awbnos) {
+			end = len(awbnos)
+		}
+		var buf bytes.Buffer
+		enc := json.NewEncoder(&buf)
+		for _, awbno := range awbnos[start:end] {
+			if err := enc.Encode(header); err != nil {
+				return nil, err
+			}
+			if err := enc.Encode(esSearchBody{
+				Size:  &size,
+				Sort:  esHistorySort(),
+				Query: esMust(esTerm("awb_no", awbno), esRange("update_time", from, to, true)),
+			}); err != nil {
+				return nil, err
+			}
+		}
+		req := esapi.MsearchRequest{Body: &buf}
+		res, err := req.Do(context.Background(), s.es7.Transport)
+		if err != nil {
+			return nil, err
+		}
+		if res.IsError() {
+			closeResponse(res)
+			return nil, errors.New("検索に失敗しました " + res.String())
+		}
+		var r struct {
+			Responses []struct {
+				esSearchResponse
+				Error  json.RawMessage `json:"error"`
+				Status int             `json:"status"`
+			} `json:"responses"`
+		}
+		err = json.NewDecoder(res.Body).Decode(&r)
+		closeResponse(res)
+		if err != nil {
+			return nil, err
+		}
+		//応答は検索した順に返る
+		for i, awbno := range awbnos[start:end] {
+			if i >= len(r.Responses) {
+				return nil, errors.New("検索結果の件数が一致しません")
+			}
+			if len(r.Responses[i].Error) > 0 {
+				return nil, errors.New("検索に失敗しました " + awbno + " " + string(r.Responses[i].Error))
+			}
+			//1回で取得しきれなかったAWBは続きを含めて検索し直す
+			if len(r.Responses[i].Hits.Hits) >= size {
+				docs, err := s.History(awbno, from, to)
+				if err != nil {
+					return nil, err
+				}
+				result[awbno] = docs
+				continue
+			}
+			docs := make([]StsDoc, 0, len(r.Responses[i].Hits.Hits))
+			for _, hit := range r.Responses[i].Hits.Hits {
+				docs = append(docs, hit.Source)
+			}
+			result[awbno] = docs
+		}
+	}
+	return result, nil
+}
+
+// 1回の集計で返すAWBの数。超える分はafter_keyで続きを取得する
+const esLatestPageSize = 1000
+
+func (s *esStore) Latest(from, to int64) ([]StsDoc, error) {
+	indices, err := s.indicesBetween(from, to)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]StsDoc, 0, 100)
+	var after json.RawMessage
+	for {
+		r, err := s.search(indices, esSearchBody{
+			Aggs: esLatestPerAwbPage(esRange("update_time", from, to, false), esLatestPageSize, after),
+		}, 0)
+		if err != nil {
+			return nil, err
+		}
+		page := r.Aggregations.F.Page
+		for _, bucket := range page.Buckets {
+			if len(bucket.Latest.Hits.Hits) > 0 {
+				result = append(result, bucket.Latest.Hits.Hits[0].Source)
+			}
+		}
+		if len(page.Buckets) < esLatestPageSize || len(page.AfterKey) < 1 {
+			return result, nil
+		}
+		after = page.AfterKey
+	}
+}
+
+func (s *esStore) LatestOf(awbnos []string, from, to int64) (map[string]StsDoc, error) {
+	result := make(map[string]StsDoc, len(awbnos))
+	indices, err := s.indicesBetween(from, to)
+	if err != nil {
+		return nil, err
+	}
+	for start := 0; start < len(awbnos); start += esMsearchChunk {
+		end := start + esMsearchChunk
+		if end > len(awbnos) {
+			end = len(awbnos)
+		}
+		r, err := s.search(indices, esSearchBody{
+			Aggs: esLatestPerAwb(esMust(esTerms("awb_no", awbnos[start:end]), esRange("update_time", from, to, false)), end-start),
+		}, 0)
+		if err != nil {
+			return nil, err
+		}
+		for _, bucket := range r.Aggregations.F.Awbs.Buckets {
+			if len(bucket.Latest.Hits.Hits) < 1 {
+				continue
+			}
+			doc := bucket.Latest.Hits.Hits[0].Source
+			doc.Awbno = bucket.Key
+			result[bucket.Key] = doc
+		}
+	}
+	return result, nil
+}
+
+func (s *esStore) Purge(days int) error {
+	return purgeExpired(s, days)
+}
+
+func (s *esStore) Days() ([]string, error) {
+	req := esapi.CatIndicesRequest{
+		Index:  []string{esIndexPrefix + "*"},
+		Format: "json",
+		H:      []string{"index"},
+	}
+	res, err := req.Do(context.Background(), s.es7.Transport)
+	if err != nil {
+		return nil, err
+	}
+	defer closeResponse(res)
+	if res.IsError() {
+		return nil, errors.New("インデックス一覧の取得に失敗しました " + res.String())
+	}
+	var indices []struct {
+		Index string `json:"index"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&indices); err != nil {
+		return nil, err
+	}
+	days := make([]string, 0, len(indices))
+	for _, idx := range indices {
+		//他の倉庫のプレフィックス(例:sts_index_b_)のインデックスは除く
+		day := strings.TrimPrefix(idx.Index, esIndexPrefix)
+		if _, err := time.Parse("20060102", day); err != nil {
+			continue
+		}
+		days = append(days, day)
+	}
+	sort.Strings(days)
+	return days, nil
+}
+
+func (s *esStore) EachDoc(day string, fn func(StsDoc) error) error {
+	size := 5000
+	body, err := esSearchBody{Sort: esSort("update_time", "asc")}.reader()
+	if err != nil {
+		return err
+	}
+	req := esapi.SearchRequest{
+		Index:  []string{esIndexPrefix + day},
+		Body:   body,
+		Size:   &size,
+		Scroll: time.Minute,
+	}
+	res, err := req.Do(context.Background(), s.es7.Transport)
+	//削除済みの日(インデックスがない)は記録がない日として扱う
+	if err == nil && res.StatusCode == 404 {
+		closeResponse(res)
+		return nil
+	}
+	for {
+		if err != nil {
+			return err
+		}
+		if res.IsError() {
+			msg := res.String()
+			closeResponse(res)
+			return errors.New("検索に失敗しました " + msg)
+		}
+		var r esSearchResponse
+		err = json.NewDecoder(res.Body).Decode(&r)
+		closeResponse(res)
+		if err != nil {
+			return err
+		}
+		if len(r.Hits.Hits) < 1 {
+			creq := esapi.ClearScrollRequest{ScrollID: []string{r.ScrollID}}
+			if cres, err := creq.Do(context.Background(), s.es7.Transport); err == nil {
+				closeResponse(cres)
+			}
+			return nil
+		}
+		for _, hit := range r.Hits.Hits {
+			if err := fn(hit.Source); err != nil {
+				return err
+			}
+		}
+		sreq := esapi.ScrollRequest{ScrollID: r.ScrollID, Scroll: time.Minute}
+		res, err = sreq.Do(context.Background(), s.es7.Transport)
+	}
+}
+
+func (s *esStore) DropDay(day string) error {
+	req := esapi.IndicesDeleteRequest{
+		Index: []string{esIndexPrefix + day},
+	}
+
+	res, err := req.Do(context.Background(), s.es7.Transport)
+	if err != nil {
+		return err
+	}
+	closeResponse(res)
+	s.mu.Lock()
+	delete(s.created, esIndexPrefix+day)
+	s.mu.Unlock()
+	return nil
+}
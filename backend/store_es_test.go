@@ -0,0 +1,518 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 検索だけを受け付けるElasticsearchの代わり。インデックス名ごとに記録を持つ
+type fakeEs struct {
+	mu       sync.Mutex
+	indices  map[string][]StsDoc
+	ids      map[string]int
+	searches [][]string
+	//スクロールIDごとの残りの記録
+	scrolls map[string][]interface{}
+	//インデックスの確認と作成に返すステータスと本文。0の場合は成功を返す
+	existsStatus int
+	createStatus int
+	createBody   string
+}
+
+func (f *fakeEs) setIndexStatus(exists, create int, body string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.existsStatus, f.createStatus, f.createBody = exists, create, body
+}
+
+func newFakeEs(t *testing.T) (*fakeEs, *esStore) {
+	f := &fakeEs{indices: make(map[string][]StsDoc), ids: make(map[string]int), scrolls: make(map[string][]interface{})}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	esAddresses, esUsername, esPassword, esAPIKey, esCACertPath = []string{srv.URL}, "", "", "", ""
+	esIndexPrefix = "sts_index_"
+	s, err := newEsStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f, s
+}
+
+func (f *fakeEs) add(docs ...StsDoc) {
+	for _, doc := range docs {
+		f.addTo(esIndexName(time.UnixMilli(doc.UpdateTime)), doc)
+	}
+}
+
+func (f *fakeEs) addTo(index string, doc StsDoc) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.indices[index] = append(f.indices[index], doc)
+}
+
+func (f *fakeEs) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("X-Elastic-Product", "Elasticsearch")
+	w.Header().Set("Content-Type", "application/json")
+	path := strings.Trim(r.URL.Path, "/")
+	switch {
+	case r.Method == http.MethodHead:
+		f.mu.Lock()
+		status := f.existsStatus
+		f.mu.Unlock()
+		if status == 0 {
+			status = http.StatusOK
+		}
+		w.WriteHeader(status)
+	case r.Method == http.MethodPut && !strings.Contains(path, "/"):
+		f.mu.Lock()
+		status, body := f.createStatus, f.createBody
+		f.mu.Unlock()
+		if status == 0 {
+			status, body = http.StatusOK, `{"acknowledged":true,"index":"`+path+`"}`
+		}
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	case strings.HasSuffix(path, "_bulk"):
+		//IDを指定した登録は同じIDの記録を置き換える
+		items := make([]interface{}, 0, 10)
+		sc := bufio.NewScanner(r.Body)
+		sc.Buffer(make([]byte, 64*1024), 1024*1024)
+		for sc.Scan() {
+			var action map[string]struct {
+				Index string `json:"_index"`
+				ID    string `json:"_id"`
+			}
+			json.Unmarshal(sc.Bytes(), &action)
+			if !sc.Scan() {
+				break
+			}
+			var doc StsDoc
+			json.Unmarshal(sc.Bytes(), &doc)
+			for op, meta := range action {
+				f.mu.Lock()
+				if pos, ok := f.ids[meta.Index+"/"+meta.ID]; ok && meta.ID != "" {
+					f.indices[meta.Index][pos] = doc
+				} else {
+					f.ids[meta.Index+"/"+meta.ID] = len(f.indices[meta.Index])
+					f.indices[meta.Index] = append(f.indices[meta.Index], doc)
+				}
+				f.mu.Unlock()
+				items = append(items, map[string]interface{}{op: map[string]interface{}{"_index": meta.Index, "_id": meta.ID, "status": 201}})
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"errors": false, "items": items})
+	case path == "":
+		w.Write([]byte(`{"version":{"number":"7.16.0"},"tagline":"You Know, for Search"}`))
+	case strings.HasPrefix(path, "_cat/indices"):
+		pattern := strings.TrimSuffix(strings.TrimPrefix(path, "_cat/indices/"), "*")
+		f.mu.Lock()
+		names := make([]map[string]string, 0, len(f.indices))
+		for name := range f.indices {
+			if strings.HasPrefix(name, pattern) {
+				names = append(names, map[string]string{"index": name})
+			}
+		}
+		f.mu.Unlock()
+		json.NewEncoder(w).Encode(names)
+	case strings.HasSuffix(path, "_msearch"):
+		responses := make([]interface{}, 0, 10)
+		sc := bufio.NewScanner(r.Body)
+		sc.Buffer(make([]byte, 64*1024), 1024*1024)
+		for sc.Scan() {
+			var header esMsearchHeader
+			json.Unmarshal(sc.Bytes(), &header)
+			if !sc.Scan() {
+				break
+			}
+			var body map[string]interface{}
+			json.Unmarshal(sc.Bytes(), &body)
+			size := 10
+			if v, ok := body["size"].(float64); ok {
+				size = int(v)
+			}
+			responses = append(responses, f.search(header.Index, body, size))
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"responses": responses})
+	case path == "_search/scroll":
+		if r.Method == http.MethodDelete {
+			w.Write([]byte(`{"succeeded":true}`))
+			return
+		}
+		var body struct {
+			ScrollID string `json:"scroll_id"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		json.NewEncoder(w).Encode(f.nextScroll(body.ScrollID))
+	case strings.HasSuffix(path, "_search"):
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		size, err := strconv.Atoi(r.URL.Query().Get("size"))
+		if err != nil {
+			size = 10
+		}
+		indices := strings.Split(strings.TrimSuffix(strings.TrimSuffix(path, "_search"), "/"), ",")
+		//ignore_unavailableを指定しない検索で、ないインデックスを指定した場合は404を返す
+		if r.URL.Query().Get("ignore_unavailable") != "true" {
+			for _, name := range indices {
+				if !strings.Contains(name, "*") && !f.exists(name) {
+					w.WriteHeader(http.StatusNotFound)
+					w.Write([]byte(`{"error":{"type":"index_not_found_exception","index":"` + name + `"},"status":404}`))
+					return
+				}
+			}
+		}
+		if r.URL.Query().Get("scroll") != "" {
+			json.NewEncoder(w).Encode(f.startScroll(f.search(indices, body, 1<<30), size))
+			return
+		}
+		json.NewEncoder(w).Encode(f.search(indices, body, size))
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{}`))
+	}
+}
+
+func (f *fakeEs) exists(index string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, ok := f.indices[index]
+	return ok
+}
+
+// 検索結果の全件をsize件ずつ返す
+func (f *fakeEs) startScroll(result map[string]interface{}, size int) map[string]interface{} {
+	f.mu.Lock()
+	id := "scroll" + strconv.Itoa(len(f.scrolls))
+	f.scrolls[id] = result["hits"].(map[string]interface{})["hits"].([]interface{})
+	f.mu.Unlock()
+	return f.pageScroll(id, size)
+}
+
+func (f *fakeEs) nextScroll(id string) map[string]interface{} {
+	return f.pageScroll(id, 1000)
+}
+
+func (f *fakeEs) pageScroll(id string, size int) map[string]interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	hits := f.scrolls[id]
+	if len(hits) > size {
+		hits = hits[:size]
+	}
+	f.scrolls[id] = f.scrolls[id][len(hits):]
+	return map[string]interface{}{"_scroll_id": id, "hits": map[string]interface{}{"hits": hits}}
+}
+
+func (f *fakeEs) search(indices []string, body map[string]interface{}, size int) map[string]interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.searches = append(f.searches, indices)
+	docs := make([]StsDoc, 0, 100)
+	for name, idocs := range f.indices {
+		for _, pattern := range indices {
+			if name == pattern || (strings.HasSuffix(pattern, "*") && strings.HasPrefix(name, strings.TrimSuffix(pattern, "*"))) {
+				docs = append(docs, idocs...)
+				break
+			}
+		}
+	}
+	result := map[string]interface{}{}
+	if aggs, ok := body["aggs"].(map[string]interface{}); ok {
+		filter := aggs["f"].(map[string]interface{})["filter"]
+		latest := make(map[string]StsDoc)
+		for _, doc := range docs {
+			if matchEsQuery(filter, doc) {
+				if l, ok := latest[doc.Awbno]; !ok || l.UpdateTime < doc.UpdateTime {
+					latest[doc.Awbno] = doc
+				}
+			}
+		}
+		awbs := make([]string, 0, len(latest))
+		for awb := range latest {
+			awbs = append(awbs, awb)
+		}
+		sort.Strings(awbs)
+		bucket := func(key interface{}, doc StsDoc) interface{} {
+			return map[string]interface{}{"key": key, "latest": map[string]interface{}{"hits": map[string]interface{}{"hits": []interface{}{map[string]interface{}{"_source": doc}}}}}
+		}
+		agg := map[string]interface{}{}
+		if page, ok := aggs["f"].(map[string]interface{})["aggs"].(map[string]interface{})["page"]; ok {
+			//compositeはAWB番号順にafterの続きからsize件を返す
+			composite := page.(map[string]interface{})["composite"].(map[string]interface{})
+			after := ""
+			if a, ok := composite["after"].(map[string]interface{}); ok {
+				after = a["awb"].(string)
+			}
+			buckets := make([]interface{}, 0, 100)
+			last := ""
+			for _, awb := range awbs {
+				if awb > after && len(buckets) < int(composite["size"].(float64)) {
+					buckets = append(buckets, bucket(map[string]string{"awb": awb}, latest[awb]))
+					last = awb
+				}
+			}
+			agg["page"] = map[string]interface{}{"buckets": buckets, "after_key": map[string]string{"awb": last}}
+		} else {
+			buckets := make([]interface{}, 0, len(latest))
+			for _, awb := range awbs {
+				buckets = append(buckets, bucket(awb, latest[awb]))
+			}
+			agg["awbs"] = map[string]interface{}{"buckets": buckets}
+		}
+		result["aggregations"] = map[string]interface{}{"f": agg}
+	}
+	hits := make([]StsDoc, 0, len(docs))
+	for _, doc := range docs {
+		if body["query"] == nil || matchEsQuery(body["query"], doc) {
+			hits = append(hits, doc)
+		}
+	}
+	sort.SliceStable(hits, func(i, j int) bool {
+		if hits[i].UpdateTime != hits[j].UpdateTime {
+			return hits[i].UpdateTime < hits[j].UpdateTime
+		}
+		return hits[i].Event < hits[j].Event
+	})
+	if after, ok := body["search_after"].([]interface{}); ok {
+		t, event := int64(after[0].(float64)), after[1].(string)
+		kept := make([]StsDoc, 0, len(hits))
+		for _, doc := range hits {
+			if doc.UpdateTime > t || (doc.UpdateTime == t && doc.Event > event) {
+				kept = append(kept, doc)
+			}
+		}
+		hits = kept
+	}
+	if len(hits) > size {
+		hits = hits[:size]
+	}
+	out := make([]interface{}, 0, len(hits))
+	for _, doc := range hits {
+		out = append(out, map[string]interface{}{"_source": doc, "sort": []interface{}{doc.UpdateTime, doc.Event}})
+	}
+	result["hits"] = map[string]interface{}{"hits": out}
+	return result
+}
+
+// bool.must、term、terms、rangeだけを評価する
+func matchEsQuery(q interface{}, doc StsDoc) bool {
+	fields := map[string]interface{}{"awb_no": doc.Awbno, "update_time": float64(doc.UpdateTime)}
+	for kind, v := range q.(map[string]interface{}) {
+		cond := v.(map[string]interface{})
+		switch kind {
+		case "bool":
+			for _, sub := range cond["must"].([]interface{}) {
+				if !matchEsQuery(sub, doc) {
+					return false
+				}
+			}
+		case "term":
+			for field, fv := range cond {
+				if fields[field] != fv.(map[string]interface{})["value"] {
+					return false
+				}
+			}
+		case "terms":
+			for field, values := range cond {
+				found := false
+				for _, value := range values.([]interface{}) {
+					found = found || fields[field] == value
+				}
+				if !found {
+					return false
+				}
+			}
+		case "range":
+			for field, bounds := range cond {
+				n := fields[field].(float64)
+				for op, bound := range bounds.(map[string]interface{}) {
+					b := bound.(float64)
+					if (op == "gte" && n < b) || (op == "lt" && n >= b) || (op == "lte" && n > b) {
+						return false
+					}
+				}
+			}
+		}
+	}
+	return true
+}
+
+func TestEsHistoryPaging(t *testing.T) {
+	f, s := newFakeEs(t)
+	t0 := testBaseTime()
+	//引き継ぐ記録の後、fromからの記録が1回の検索の上限を超える
+	f.add(StsDoc{Awbno: "A", StatusCode: "50", UpdateTime: t0.Add(-20 * time.Hour).UnixMilli(), Event: eventChanged})
+	for i := 0; i < esHistoryPageSize+500; i++ {
+		f.add(StsDoc{Awbno: "A", StatusCode: "50", UpdateTime: t0.Add(-10*time.Hour).UnixMilli() + int64(i), Event: eventHeartbeat})
+	}
+	total := esHistoryPageSize*2 + 10
+	for i := 0; i < total; i++ {
+		code := "50"
+		if i == total-1 {
+			code = "70"
+		}
+		f.add(StsDoc{Awbno: "A", StatusCode: code, UpdateTime: t0.UnixMilli() + int64(i), Event: eventHeartbeat})
+	}
+	from, to := t0.UnixMilli(), t0.Add(time.Hour).UnixMilli()
+
+	carried, hits, err := historyWithCarry(s, "A", from, to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if carried == nil || carried.UpdateTime != t0.Add(-10*time.Hour).UnixMilli()+int64(esHistoryPageSize+499) {
+		t.Fatalf("引き継ぐ記録が違います:%+v", carried)
+	}
+	if len(hits) != total || hits[0].UpdateTime != from || hits[len(hits)-1].StatusCode != "70" {
+		t.Fatalf("期間内の記録が違います:%d件", len(hits))
+	}
+
+	carrieds, histories, err := historiesWithCarry(s, []string{"A", "B"}, from, to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if carrieds["A"] == nil || carrieds["B"] != nil || len(histories["A"]) != total || len(histories["B"]) != 0 {
+		t.Fatalf("まとめて取得した記録が違います:%d件 %d件", len(histories["A"]), len(histories["B"]))
+	}
+}
+
+func TestEsIndicesBetween(t *testing.T) {
+	f, s := newFakeEs(t)
+	now := time.Now()
+	old := now.AddDate(0, 0, -10)
+	f.add(StsDoc{Awbno: "A", StatusCode: "50", UpdateTime: old.UnixMilli(), Event: eventChanged})
+	//同じElasticsearchを使う他の倉庫のインデックス
+	f.addTo("sts_index_b_"+old.Format("20060102"), StsDoc{Awbno: "B", StatusCode: "50", UpdateTime: old.UnixMilli(), Event: eventChanged})
+	f.addTo("sts_index_b_"+now.Format("20060102"), StsDoc{Awbno: "C", StatusCode: "50", UpdateTime: now.UnixMilli(), Event: eventChanged})
+
+	docs, err := s.Latest(now.AddDate(0, 0, -14).UnixMilli(), now.UnixMilli()+1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(docs) != 1 || docs[0].Awbno != "A" {
+		t.Fatalf("他の倉庫の記録が含まれています:%+v", docs)
+	}
+	for _, indices := range f.searches {
+		for _, idx := range indices {
+			if strings.Contains(idx, "*") || strings.HasPrefix(idx, "sts_index_b_") {
+				t.Fatalf("検索するインデックスが違います:%v", indices)
+			}
+		}
+	}
+
+	//短い期間は日毎のインデックスを指定する
+	indices, err := s.indicesBetween(now.AddDate(0, 0, -2).UnixMilli(), now.UnixMilli())
+	if err != nil || len(indices) != 3 || indices[2] != esIndexName(now) {
+		t.Fatalf("インデックスが違います:%v %v", indices, err)
+	}
+}
+
+func TestEsLatestPaging(t *testing.T) {
+	f, s := newFakeEs(t)
+	t0 := testBaseTime()
+	//1回の集計で返す件数を超えるAWB
+	total := esLatestPageSize*2 + 10
+	for i := 0; i < total; i++ {
+		awb := strconv.Itoa(10000000 + i)
+		f.add(StsDoc{Awbno: awb, StatusCode: "50", UpdateTime: t0.UnixMilli(), Event: eventChanged},
+			StsDoc{Awbno: awb, StatusCode: "70", UpdateTime: t0.Add(time.Minute).UnixMilli(), Event: eventChanged})
+	}
+	docs, err := s.Latest(t0.UnixMilli(), t0.Add(time.Hour).UnixMilli())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(docs) != total {
+		t.Fatalf("件数が違います:%d件", len(docs))
+	}
+	seen := make(map[string]bool, total)
+	for _, doc := range docs {
+		if doc.StatusCode != "70" || seen[doc.Awbno] {
+			t.Fatalf("最新の記録が違います:%+v", doc)
+		}
+		seen[doc.Awbno] = true
+	}
+}
+
+func TestEsAppendIdempotent(t *testing.T) {
+	f, s := newFakeEs(t)
+	t0 := testBaseTime()
+	docs := []StsDoc{
+		{Awbno: "A", StatusCode: "50", UpdateTime: t0.UnixMilli(), Event: eventChanged},
+		{Awbno: "A", StatusCode: "50", UpdateTime: t0.UnixMilli(), Event: eventHeartbeat},
+		{Awbno: "B", StatusCode: "70", UpdateTime: t0.UnixMilli(), Event: eventChanged},
+	}
+	//取り込みの再試行やアーカイブの再取り込みで同じ記録を登録し直す
+	for i := 0; i < 2; i++ {
+		if err := s.Append(docs); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := len(f.indices[esIndexName(t0)]); n != len(docs) {
+		t.Fatalf("記録が重複しています:%d件", n)
+	}
+	if _, ok := f.ids[esIndexName(t0)+"/"+stsDocKey(docs[0])]; !ok {
+		t.Fatalf("IDが違います:%v", f.ids)
+	}
+}
+
+func TestEsArchiveImport(t *testing.T) {
+	f, s := newFakeEs(t)
+	dir := t.TempDir()
+	if err := loadArchiveSettings(map[string]string{"ArchiveFolderPath": dir}); err != nil {
+		t.Fatal(err)
+	}
+	defer loadArchiveSettings(map[string]string{})
+	old := time.Now().AddDate(0, 0, -10)
+	day := old.Format("20060102")
+	//アーカイブを作った後、インデックスは削除済み
+	m := newMemStore()
+	m.Append([]StsDoc{
+		{Awbno: "A", StatusCode: "50", UpdateTime: old.UnixMilli(), Event: eventChanged},
+		{Awbno: "A", StatusCode: "70", UpdateTime: old.Add(10 * time.Minute).UnixMilli(), Event: eventChanged},
+	})
+	if err := archiveDay(m, day); err != nil {
+		t.Fatal(err)
+	}
+	archive := filepath.Join(dir, "sts_index_"+day+".ndjson.gz")
+
+	for i, want := range []int{2, 0} {
+		n, err := importArchive(s, archive)
+		if err != nil || n != want {
+			t.Fatalf("%d回目の取り込み件数が違います:%d %v", i+1, n, err)
+		}
+	}
+	if n := len(f.indices[esIndexPrefix+day]); n != 2 {
+		t.Fatalf("取り込んだ記録が違います:%d件", n)
+	}
+}
+
+func TestEsEnsureIndex(t *testing.T) {
+	f, s := newFakeEs(t)
+	for _, c := range []struct {
+		exists, create int
+		body           string
+		ok             bool
+	}{
+		{http.StatusForbidden, 0, "", false},
+		{http.StatusNotFound, http.StatusUnauthorized, `{"error":{"type":"security_exception"},"status":401}`, false},
+		{http.StatusNotFound, http.StatusInternalServerError, `{"error":{"type":"exception"},"status":500}`, false},
+		//他のプロセスが先に作成した
+		{http.StatusNotFound, http.StatusBadRequest, `{"error":{"type":"resource_already_exists_exception"},"status":400}`, true},
+		{http.StatusNotFound, 0, "", true},
+	} {
+		f.setIndexStatus(c.exists, c.create, c.body)
+		name := "sts_index_" + strconv.Itoa(c.exists) + "_" + strconv.Itoa(c.create)
+		err := s.ensureIndex(name)
+		if (err == nil) != c.ok || s.created[name] != c.ok {
+			t.Fatalf("%d %d:結果が違います:%v", c.exists, c.create, err)
+		}
+	}
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Elasticsearchを使わずにローカルフォルダへ日毎のNDJSONファイル(sts_index_YYYYMMDD.ndjson)として保存する格納先
+// 当日と前日のデータはAWBごとにメモリ上にも保持する。それより前の日は参照するたびにファイルから読み込む
+type fileStore struct {
+	dir  string
+	mu   sync.Mutex
+	days map[string]map[string][]StsDoc
+}
+
+var storeFolderPath string
+
+func newFileStore(dir string) (*fileStore, error) {
+	if dir == "" {
+		return nil, errors.New("StoreFolderPathが設定されていません")
+	}
+	return &fileStore{dir: dir, days: make(map[string]map[string][]StsDoc)}, nil
+}
+
+func (s *fileStore) fileName(day string) string {
+	return filepath.Join(s.dir, `sts_index_`+day+`.ndjson`)
+}
+
+// 呼び出し側でロックを取得しておくこと
+func (s *fileStore) loadDay(day string) (map[string][]StsDoc, error) {
+	if docs, ok := s.days[day]; ok {
+		return docs, nil
+	}
+	docs := make(map[string][]StsDoc)
+	f, err := os.Open(s.fileName(day))
+	if os.IsNotExist(err) {
+		s.cacheDay(day, docs)
+		return docs, nil
+	} else if err != nil {
+		return nil, err
+	}
+	//最後の改行までの長さ
+	var complete int64
+	partial := false
+	err = func() error {
+		defer f.Close()
+		r := bufio.NewReader(f)
+		for {
+			line, err := r.ReadBytes('\n')
+			if err == io.EOF {
+				partial = len(line) > 0
+				return nil
+			} else if err != nil {
+				return err
+			}
+			complete += int64(len(line))
+			if len(bytes.TrimSpace(line)) == 0 {
+				continue
+			}
+			var doc StsDoc
+			if err := json.Unmarshal(line, &doc); err != nil {
+				return err
+			}
+			docs[doc.Awbno] = append(docs[doc.Awbno], doc)
+		}
+	}()
+	if err != nil {
+		return nil, err
+	}
+	//登録中に停止して改行で終わっていない行は、次の登録で壊れた行にならないように切り詰める
+	if partial {
+		log.Printf("書き込み途中の行を削除します:%s", s.fileName(day))
+		if err := os.Truncate(s.fileName(day), complete); err != nil {
+			return nil, err
+		}
+	}
+	for awb := range docs {
+		hist := docs[awb]
+		sort.SliceStable(hist, func(i, j int) bool { return hist[i].UpdateTime < hist[j].UpdateTime })
+	}
+	s.cacheDay(day, docs)
+	return docs, nil
+}
+
+// 前日分は前の状態を引き継ぐための検索で毎回参照されるため当日分と合わせて保持する
+// 呼び出し側でロックを取得しておくこと
+func (s *fileStore) cacheDay(day string, docs map[string][]StsDoc) {
+	now := time.Now()
+	today, yesterday := now.Format("20060102"), now.AddDate(0, 0, -1).Format("20060102")
+	for cached := range s.days {
+		if cached != today && cached != yesterday {
+			delete(s.days, cached)
+		}
+	}
+	if day == today || day == yesterday {
+		s.days[day] = docs
+	}
+}
+
+func (s *fileStore) Prepare() error {
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err := s.loadDay(time.Now().Format("20060102"))
+	return err
+}
+
+func (s *fileStore) Append(docs []StsDoc) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	byDay := make(map[string][]StsDoc)
+	for _, doc := range docs {
+		day := time.UnixMilli(doc.UpdateTime).Local().Format("20060102")
+		byDay[day] = append(byDay[day], doc)
+	}
+	for day, ddocs := range byDay {
+		cache, err := s.loadDay(day)
+		if err != nil {
+			return err
+		}
+		f, err := os.OpenFile(s.fileName(day), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			return err
+		}
+		w := bufio.NewWriter(f)
+		enc := json.NewEncoder(w)
+		for _, doc := range ddocs {
+			if err := enc.Encode(doc); err != nil {
+				f.Close()
+				return err
+			}
+		}
+		if err := w.Flush(); err != nil {
+			f.Close()
+			return err
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+		for _, doc := range ddocs {
+			cache[doc.Awbno] = insertByUpdateTime(cache[doc.Awbno], doc)
+		}
+		countStored(uint64(len(ddocs)), 0, 1)
+	}
+	return nil
+}
+
+// Latest、LatestOfは古い順に並んでいる前提で後ろから探すため、取り込みや遅れて届いた記録も時刻順の位置に入れる
+// 同じ時刻の記録は後に登録したものを後ろにする
+func insertByUpdateTime(hist []StsDoc, doc StsDoc) []StsDoc {
+	pos := sort.Search(len(hist), func(i int) bool { return hist[i].UpdateTime > doc.UpdateTime })
+	hist = append(hist, StsDoc{})
+	copy(hist[pos+1:], hist[pos:])
+	hist[pos] = doc
+	return hist
+}
+
+func (s *fileStore) History(awbno string, from, to int64) ([]StsDoc, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	result := make([]StsDoc, 0, 100)
+	for _, day := range daysBetween(from, to) {
+		docs, err := s.loadDay(day)
+		if err != nil {
+			return nil, err
+		}
+		for _, doc := range docs[awbno] {
+			if doc.UpdateTime >= from && doc.UpdateTime <= to {
+				result = append(result, doc)
+			}
+		}
+	}
+	return result, nil
+}
+
+func (s *fileStore) HistoryMany(awbnos []string, from, to int64) (map[string][]StsDoc, error) {
+	return historyEach(s, awbnos, from, to)
+}
+
+func (s *fileStore) Latest(from, to int64) ([]StsDoc, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	latest := make(map[string]StsDoc)
+	for _, day := range daysBetween(from, to) {
+		docs, err := s.loadDay(day)
+		if err != nil {
+			return nil, err
+		}
+		for awb, hist := range docs {
+			for idx := len(hist) - 1; idx >= 0; idx-- {
+				doc := hist[idx]
+				if doc.UpdateTime >= to {
+					continue
+				} else if doc.UpdateTime < from {
+					break
+				}
+				if l, ok := latest[awb]; !ok || l.UpdateTime < doc.UpdateTime {
+					latest[awb] = doc
+				}
+				break
+			}
+		}
+	}
+	result := make([]StsDoc, 0, len(latest))
+	for _, doc := range latest {
+		result = append(result, doc)
+	}
+	sort.SliceStable(result, func(i, j int) bool { return result[i].Awbno < result[j].Awbno })
+	return result, nil
+}
+
+func (s *fileStore) LatestOf(awbnos []string, from, to int64) (map[string]StsDoc, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	result := make(map[string]StsDoc, len(awbnos))
+	days := daysBetween(from, to)
+	//新しい日から探し、見つかったAWBはそれより前の日を見ない
+	for i := len(days) - 1; i >= 0; i-- {
+		docs, err := s.loadDay(days[i])
+		if err != nil {
+			return nil, err
+		}
+		for _, awbno := range awbnos {
+			if _, ok := result[awbno]; ok {
+				continue
+			}
+			hist := docs[awbno]
+			for idx := len(hist) - 1; idx >= 0; idx-- {
+				if hist[idx].UpdateTime < to && hist[idx].UpdateTime >= from {
+					result[awbno] = hist[idx]
+					break
+				}
+			}
+		}
+	}
+	return result, nil
+}
+
+func (s *fileStore) Purge(days int) error {
+	return purgeExpired(s, days)
+}
+
+func (s *fileStore) Days() ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(s.dir, `sts_index_*.ndjson`))
+	if err != nil {
+		return nil, err
+	}
+	days := make([]string, 0, len(files))
+	for _, file := range files {
+		days = append(days, strings.TrimSuffix(strings.TrimPrefix(filepath.Base(file), `sts_index_`), `.ndjson`))
+	}
+	sort.Strings(days)
+	return days, nil
+}
+
+func (s *fileStore) EachDoc(day string, fn func(StsDoc) error) error {
+	s.mu.Lock()
+	cache, err := s.loadDay(day)
+	if err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	docs := make([]StsDoc, 0, 100)
+	for _, hist := range cache {
+		docs = append(docs, hist...)
+	}
+	s.mu.Unlock()
+	for _, doc := range docs {
+		if err := fn(doc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *fileStore) DropDay(day string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.days, day)
+	if err := os.Remove(s.fileName(day)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileStoreCachesRecentDays(t *testing.T) {
+	s, err := newFileStore(filepath.Join(t.TempDir(), "store"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Prepare(); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	old := now.AddDate(0, 0, -5)
+	if err := s.Append([]StsDoc{
+		{Awbno: "A", StatusCode: "50", UpdateTime: old.UnixMilli(), Event: eventChanged},
+		{Awbno: "A", StatusCode: "70", UpdateTime: now.UnixMilli(), Event: eventChanged},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	h, err := s.History("A", old.UnixMilli(), now.UnixMilli())
+	if err != nil || len(h) != 2 || h[0].StatusCode != "50" {
+		t.Fatalf("履歴が違います:%+v %v", h, err)
+	}
+	//過去の日はメモリ上に残さない
+	if _, ok := s.days[old.Format("20060102")]; ok || len(s.days) > 2 {
+		t.Fatalf("過去の日を保持しています:%d日分", len(s.days))
+	}
+	if _, ok := s.days[now.Format("20060102")]; !ok {
+		t.Fatal("当日分を保持していません")
+	}
+
+	//別のインスタンスからも同じ内容を読み込める
+	s2, _ := newFileStore(s.dir)
+	latest, err := s2.LatestOf([]string{"A"}, old.UnixMilli(), now.UnixMilli()+1)
+	if err != nil || latest["A"].StatusCode != "70" {
+		t.Fatalf("最新の記録が違います:%+v %v", latest, err)
+	}
+	h, err = s2.History("A", old.UnixMilli(), old.UnixMilli()+1)
+	if err != nil || len(h) != 1 {
+		t.Fatalf("過去の日を読み込めません:%+v %v", h, err)
+	}
+}
+
+func TestFileStoreOutOfOrderAppend(t *testing.T) {
+	s, err := newFileStore(filepath.Join(t.TempDir(), "store"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Prepare(); err != nil {
+		t.Fatal(err)
+	}
+	t0 := time.Now().Add(-time.Hour)
+	s.Append([]StsDoc{{Awbno: "A", StatusCode: "70", UpdateTime: t0.Add(30 * time.Minute).UnixMilli(), Event: eventChanged}})
+	//後から登録した古い記録(アーカイブの取り込みなど)
+	s.Append([]StsDoc{{Awbno: "A", StatusCode: "50", UpdateTime: t0.UnixMilli(), Event: eventChanged}})
+	latest, err := s.Latest(t0.UnixMilli(), time.Now().UnixMilli())
+	if err != nil || len(latest) != 1 || latest[0].StatusCode != "70" {
+		t.Fatalf("最新の記録が違います:%+v %v", latest, err)
+	}
+	of, err := s.LatestOf([]string{"A"}, t0.UnixMilli(), time.Now().UnixMilli())
+	if err != nil || of["A"].StatusCode != "70" {
+		t.Fatalf("最新の記録が違います:%+v %v", of, err)
+	}
+	h, err := s.History("A", t0.UnixMilli(), time.Now().UnixMilli())
+	if err != nil || len(h) != 2 || h[0].StatusCode != "50" {
+		t.Fatalf("履歴の順序が違います:%+v %v", h, err)
+	}
+}
+
+func TestFileStorePartialLine(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "store")
+	s, err := newFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Prepare(); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	s.Append([]StsDoc{{Awbno: "A", StatusCode: "50", UpdateTime: now.UnixMilli(), Event: eventChanged}})
+	//登録中に停止して最後の行が途中までになった
+	name := s.fileName(now.Format("20060102"))
+	f, err := os.OpenFile(name, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"awb_no":"B","status`)
+	f.Close()
+
+	s2, _ := newFileStore(dir)
+	if err := s2.Prepare(); err != nil {
+		t.Fatalf("読み込めません:%v", err)
+	}
+	if err := s2.Append([]StsDoc{{Awbno: "B", StatusCode: "70", UpdateTime: now.UnixMilli() + 1, Event: eventChanged}}); err != nil {
+		t.Fatal(err)
+	}
+	//切り詰めた後に登録した行も読み込める
+	s3, _ := newFileStore(dir)
+	latest, err := s3.Latest(now.UnixMilli(), now.UnixMilli()+2)
+	if err != nil || len(latest) != 2 || latest[1].StatusCode != "70" {
+		t.Fatalf("最新の記録が違います:%+v %v", latest, err)
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// プロセス内にのみ保持する格納先。テストやElasticsearchのない環境での確認用
+type memStore struct {
+	mu   sync.RWMutex
+	docs []StsDoc
+}
+
+func newMemStore() *memStore {
+	return &memStore{docs: make([]StsDoc, 0, 1000)}
+}
+
+func (s *memStore) Prepare() error {
+	return nil
+}
+
+func (s *memStore) Append(docs []StsDoc) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.docs = append(s.docs, docs...)
+	countStored(uint64(len(docs)), 0, 1)
+	return nil
+}
+
+func (s *memStore) History(awbno string, from, to int64) ([]StsDoc, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	result := make([]StsDoc, 0, 100)
+	for _, doc := range s.docs {
+		if doc.Awbno == awbno && doc.UpdateTime >= from && doc.UpdateTime <= to {
+			result = append(result, doc)
+		}
+	}
+	sort.SliceStable(result, func(i, j int) bool { return result[i].UpdateTime < result[j].UpdateTime })
+	return result, nil
+}
+
+func (s *memStore) HistoryMany(awbnos []string, from, to int64) (map[string][]StsDoc, error) {
+	return historyEach(s, awbnos, from, to)
+}
+
+func (s *memStore) Latest(from, to int64) ([]StsDoc, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	latest := make(map[string]StsDoc)
+	for _, doc := range s.docs {
+		if doc.UpdateTime < from || doc.UpdateTime >= to {
+			continue
+		}
+		if l, ok := latest[doc.Awbno]; !ok || l.UpdateTime < doc.UpdateTime {
+			latest[doc.Awbno] = doc
+		}
+	}
+	result := make([]StsDoc, 0, len(latest))
+	for _, doc := range latest {
+		result = append(result, doc)
+	}
+	sort.SliceStable(result, func(i, j int) bool { return result[i].Awbno < result[j].Awbno })
+	return result, nil
+}
+
+func (s *memStore) LatestOf(awbnos []string, from, to int64) (map[string]StsDoc, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	wanted := make(map[string]bool, len(awbnos))
+	for _, awbno := range awbnos {
+		wanted[awbno] = true
+	}
+	result := make(map[string]StsDoc, len(awbnos))
+	for _, doc := range s.docs {
+		if !wanted[doc.Awbno] || doc.UpdateTime < from || doc.UpdateTime >= to {
+			continue
+		}
+		if l, ok := result[doc.Awbno]; !ok || l.UpdateTime <= doc.UpdateTime {
+			result[doc.Awbno] = doc
+		}
+	}
+	return result, nil
+}
+
+func (s *memStore) Purge(days int) error {
+	return purgeExpired(s, days)
+}
+
+func (s *memStore) Days() ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	dayTable := make(map[string]bool)
+	for _, doc := range s.docs {
+		dayTable[time.UnixMilli(doc.UpdateTime).Local().Format("20060102")] = true
+	}
+	days := make([]string, 0, len(dayTable))
+	for day := range dayTable {
+		days = append(days, day)
+	}
+	sort.Strings(days)
+	return days, nil
+}
+
+func (s *memStore) EachDoc(day string, fn func(StsDoc) error) error {
+	s.mu.RLock()
+	docs := make([]StsDoc, 0, 100)
+	for _, doc := range s.docs {
+		if time.UnixMilli(doc.UpdateTime).Local().Format("20060102") == day {
+			docs = append(docs, doc)
+		}
+	}
+	s.mu.RUnlock()
+	for _, doc := range docs {
+		if err := fn(doc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *memStore) DropDay(day string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	kept := make([]StsDoc, 0, len(s.docs))
+	for _, doc := range s.docs {
+		if time.UnixMilli(doc.UpdateTime).Local().Format("20060102") == day {
+			continue
+		}
+		kept = append(kept, doc)
+	}
+	s.docs = kept
+	return nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFindTransition(t *testing.T) {
+	mk := func(codes ...string) []StsDoc {
+		docs := make([]StsDoc, 0, len(codes))
+		for i, code := range codes {
+			event := eventChanged
+			if code == "" {
+				code, event = "70", eventRemoved
+			}
+			docs = append(docs, StsDoc{StatusCode: code, UpdateTime: int64(i), Event: event})
+		}
+		return docs
+	}
+	cases := []struct {
+		name       string
+		docs       []StsDoc
+		ok         bool
+		start, end int64
+	}{
+		{"50から70", mk("40", "50", "60", "70", "72"), true, 1, 3},
+		{"未満の記録がない", mk("50", "70"), false, 0, 0},
+		{"ltに達していない", mk("40", "50", "60"), false, 0, 0},
+		{"gteとltに同時に達した", mk("40", "72"), false, 0, 0},
+		{"削除は遷移としない", mk("40", "50", "", "70"), true, 1, 3},
+	}
+	for _, c := range cases {
+		start, end, ok := findTransition(c.docs, "50", "70")
+		if ok != c.ok || (ok && (start.UpdateTime != c.start || end.UpdateTime != c.end)) {
+			t.Errorf("%s:結果が違います:%v %+v %+v", c.name, ok, start, end)
+		}
+	}
+}
+
+func TestHistoryWithCarry(t *testing.T) {
+	s := newMemStore()
+	t0 := testBaseTime().UnixMilli()
+	min := int64(60 * 1000)
+	s.Append([]StsDoc{
+		{Awbno: "A", StatusCode: "50", UpdateTime: t0 - 30*min, Event: eventChanged},
+		{Awbno: "A", StatusCode: "70", UpdateTime: t0 + 10*min, Event: eventChanged},
+		{Awbno: "B", StatusCode: "50", UpdateTime: t0 - 30*min, Event: eventChanged},
+		{Awbno: "B", StatusCode: "50", UpdateTime: t0 - 10*min, Event: eventRemoved},
+		//引き継ぐ期間より前の記録は使わない
+		{Awbno: "C", StatusCode: "50", UpdateTime: t0 - carryForwardWindow - min, Event: eventChanged},
+	})
+	carried, hits, err := historyWithCarry(s, "A", t0, t0+time.Hour.Milliseconds())
+	if err != nil || carried == nil || carried.StatusCode != "50" || len(hits) != 1 || hits[0].StatusCode != "70" {
+		t.Fatalf("引き継ぎが違います:%+v %+v %v", carried, hits, err)
+	}
+	if carried, _, _ := historyWithCarry(s, "B", t0, t0+time.Hour.Milliseconds()); carried != nil {
+		t.Fatalf("削除済みのAWBは引き継ぎません:%+v", carried)
+	}
+	if carried, _, _ := historyWithCarry(s, "C", t0, t0+time.Hour.Milliseconds()); carried != nil {
+		t.Fatalf("引き継ぐ期間より前の記録です:%+v", carried)
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// 取り込みごとの前回との差分
+type AwbDiff struct {
+	Time    time.Time   `json:"time"`
+	Added   []AwbStatus `json:"added"`
+	Removed []string    `json:"removed"`
+	Changed []AwbStatus `json:"changed"`
+}
+
+// Server-Sent Eventsで接続中の画面へ差分を配信する
+type broadcaster struct {
+	mu      sync.Mutex
+	clients map[chan []byte]bool
+}
+
+var stsStream = &broadcaster{clients: make(map[chan []byte]bool)}
+
+func (b *broadcaster) subscribe() chan []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ch := make(chan []byte, 8)
+	b.clients[ch] = true
+	return ch
+}
+
+func (b *broadcaster) unsubscribe(ch chan []byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.clients, ch)
+}
+
+// 受信が追いつかない接続には送らずに読み飛ばす
+func (b *broadcaster) publish(msg []byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.clients {
+		select {
+		case ch <- msg:
+		default:
+			log.Println("配信が滞っている接続があるため差分を破棄しました")
+		}
+	}
+}
+
+func diffStatuses(prev, cur map[string]AwbStatus) AwbDiff {
+	diff := AwbDiff{Time: time.Now(), Added: make([]AwbStatus, 0, 10), Removed: make([]string, 0, 10), Changed: make([]AwbStatus, 0, 10)}
+	for awb, c := range cur {
+		p, ok := prev[awb]
+		if !ok {
+			diff.Added = append(diff.Added, c)
+			continue
+		}
+		p.UpdateTime = c.UpdateTime
+		if p != c {
+			diff.Changed = append(diff.Changed, c)
+		}
+	}
+	for awb := range prev {
+		if _, ok := cur[awb]; !ok {
+			diff.Removed = append(diff.Removed, awb)
+		}
+	}
+	sort.SliceStable(diff.Added, func(i, j int) bool { return diff.Added[i].Awbno < diff.Added[j].Awbno })
+	sort.SliceStable(diff.Changed, func(i, j int) bool { return diff.Changed[i].Awbno < diff.Changed[j].Awbno })
+	sort.Strings(diff.Removed)
+	return diff
+}
+
+func publishDiff(diff AwbDiff) {
+	if len(diff.Added) == 0 && len(diff.Removed) == 0 && len(diff.Changed) == 0 {
+		return
+	}
+	b, err := json.Marshal(diff)
+	if err != nil {
+		log.Printf("%s", err)
+		return
+	}
+	stsStream.publish(b)
+}
+
+func streamApi(c echo.Context) error {
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, "text/event-stream")
+	res.Header().Set("Cache-Control", "no-cache")
+	res.Header().Set("Connection", "keep-alive")
+	res.WriteHeader(http.StatusOK)
+	res.Flush()
+
+	ch := stsStream.subscribe()
+	defer stsStream.unsubscribe(ch)
+	//プロキシに切断されないよう定期的にコメントを送る
+	keepalive := time.NewTicker(30 * time.Second)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-c.Request().Context().Done():
+			return nil
+		case <-keepalive.C:
+			if _, err := fmt.Fprint(res, ": keepalive\n\n"); err != nil {
+				return nil
+			}
+			res.Flush()
+		case msg := <-ch:
+			if _, err := fmt.Fprintf(res, "event: diff\ndata: %s\n\n", msg); err != nil {
+				return nil
+			}
+			res.Flush()
+		}
+	}
+}
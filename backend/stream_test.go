@@ -0,0 +1,42 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestDiffStatusesMarshal(t *testing.T) {
+	rows := []stsRow{
+		{Section: "S1", Awb: "11111111", Branch: "0", CompanyCode: "C1", CompanyName: "会社1", Status: "50", UserId: "u1", UserName: "利用者1"},
+		{Section: "S1", Awb: "22222222", Branch: "1", CompanyCode: "C1", CompanyName: "会社1", Status: "70", UserId: "u1", UserName: "利用者1"},
+	}
+	now := time.Now()
+	_, prevStatuses := stsRowStatuses(rows[:1], map[string]string{}, now.Add(-time.Minute).UnixMilli())
+	rows[0].Status = "70"
+	_, curStatuses := stsRowStatuses(rows, map[string]string{"11111111": "0"}, now.UnixMilli())
+	if !curStatuses[0].UpdateTime.Equal(now.Truncate(time.Millisecond)) {
+		t.Fatalf("update_timeがミリ秒として扱われていません:%s", curStatuses[0].UpdateTime)
+	}
+
+	prev := map[string]AwbStatus{prevStatuses[0].Awbno: prevStatuses[0]}
+	cur := make(map[string]AwbStatus)
+	for _, st := range curStatuses {
+		cur[st.Awbno] = st
+	}
+	diff := diffStatuses(prev, cur)
+	if len(diff.Added) != 1 || diff.Added[0].Awbno != "22222222-1" || len(diff.Changed) != 1 || diff.Changed[0].StatusCode != "70" {
+		t.Fatalf("差分が違います:%+v", diff)
+	}
+	b, err := json.Marshal(diff)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded AwbDiff
+	if err := json.Unmarshal(b, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if !decoded.Changed[0].UpdateTime.Equal(cur["11111111"].UpdateTime) {
+		t.Fatalf("時刻が違います:%s", decoded.Changed[0].UpdateTime)
+	}
+}
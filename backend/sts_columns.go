@@ -0,0 +1,177 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// STSファイル(TUUKANST.CSV)の列の割り当て
+// 値は0始まりの列番号か、ヘッダー行の列名
+type stsColumnDef struct {
+	Key     string
+	Setting string
+	Value   string
+}
+
+type stsRow struct {
+	Section     string
+	Awb         string
+	Branch      string
+	CompanyCode string
+	CompanyName string
+	Status      string
+	UserId      string
+	UserName    string
+}
+
+type stsColumnMap map[string]int
+
+var stsColumns []stsColumnDef
+var stsHeaderRows int
+var stsTrimSpace bool
+var stsTrimChars string
+
+func loadStsColumnSettings(settings map[string]string) error {
+	defaults := []stsColumnDef{
+		{Key: "section", Setting: "STSColumnSection", Value: "1"},
+		{Key: "awb", Setting: "STSColumnAwb", Value: "2"},
+		{Key: "branch", Setting: "STSColumnBranch", Value: "3"},
+		{Key: "company_code", Setting: "STSColumnCompanyCode", Value: "5"},
+		{Key: "company_name", Setting: "STSColumnCompanyName", Value: "6"},
+		{Key: "status", Setting: "STSColumnStatus", Value: "7"},
+		{Key: "user_id", Setting: "STSColumnUserId", Value: "11"},
+		{Key: "user_name", Setting: "STSColumnUserName", Value: "12"},
+	}
+	stsColumns = make([]stsColumnDef, 0, len(defaults))
+	for _, def := range defaults {
+		if v := strings.TrimSpace(settings[def.Setting]); v != "" {
+			def.Value = v
+		}
+		if idx, err := strconv.Atoi(def.Value); err == nil && idx < 0 {
+			return errors.New(def.Setting + "の列番号が不正です:" + def.Value)
+		}
+		stsColumns = append(stsColumns, def)
+	}
+	stsHeaderRows = 1
+	if settings["STSHeaderRows"] != "" {
+		rows, err := strconv.Atoi(settings["STSHeaderRows"])
+		if err != nil || rows < 0 {
+			return errors.New("STSHeaderRowsが不正です:" + settings["STSHeaderRows"])
+		}
+		stsHeaderRows = rows
+	}
+	//未設定なら前後の空白を取り除く
+	stsTrimSpace = settings["STSTrimSpace"] != "false"
+	stsTrimChars = settings["STSTrimChars"]
+	return nil
+}
+
+func trimStsField(field string) string {
+	if stsTrimSpace {
+		field = strings.TrimSpace(field)
+	}
+	if stsTrimChars != "" {
+		field = strings.Trim(field, stsTrimChars)
+	}
+	return field
+}
+
+// 列名で指定された列をヘッダー行から探して列番号にする。見つからない列はまとめてエラーにする
+func resolveStsColumns(header []string) (stsColumnMap, error) {
+	m := make(stsColumnMap)
+	missing := make([]string, 0, len(stsColumns))
+	for _, col := range stsColumns {
+		//列番号の場合はデータ行で確認する
+		if idx, err := strconv.Atoi(col.Value); err == nil {
+			m[col.Key] = idx
+			continue
+		}
+		found := false
+		for idx, name := range header {
+			if trimStsField(name) == col.Value {
+				m[col.Key] = idx
+				found = true
+				break
+			}
+		}
+		if !found {
+			missing = append(missing, col.Setting+"="+col.Value)
+		}
+	}
+	if len(missing) > 0 {
+		return nil, errors.New("STSファイルに必要な列がありません:" + strings.Join(missing, ","))
+	}
+	return m, nil
+}
+
+func (m stsColumnMap) row(record []string) (stsRow, error) {
+	field := func(key string) string {
+		return trimStsField(record[m[key]])
+	}
+	missing := make([]string, 0, len(stsColumns))
+	for _, col := range stsColumns {
+		if m[col.Key] >= len(record) {
+			missing = append(missing, col.Setting+"="+col.Value)
+		}
+	}
+	if len(missing) > 0 {
+		return stsRow{}, errors.New("STSファイルの列数(" + strconv.Itoa(len(record)) + ")が不足しています:" + strings.Join(missing, ",") + " 行:" + strings.Join(record, ","))
+	}
+	return stsRow{
+		Section:     field("section"),
+		Awb:         field("awb"),
+		Branch:      field("branch"),
+		CompanyCode: field("company_code"),
+		CompanyName: field("company_name"),
+		Status:      field("status"),
+		UserId:      field("user_id"),
+		UserName:    field("user_name"),
+	}, nil
+}
+
+// ヘッダー行を読み飛ばし、最後のヘッダー行を返す
+func readStsHeader(r recordReader) ([]string, error) {
+	var header []string
+	for i := 0; i < stsHeaderRows; i++ {
+		record, err := r.Read()
+		if err == io.EOF {
+			return nil, errors.New("STSファイルにデータがありません")
+		} else if err != nil {
+			return nil, err
+		}
+		header = record
+	}
+	return header, nil
+}
+
+// 起動時にSTSファイルのヘッダーと最初のデータ行で列の割り当てを確認する
+func validateStsColumns() error {
+	f, err := os.Open(stsFilePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r, err := stsFormat.newReader(f)
+	if err != nil {
+		return err
+	}
+	header, err := readStsHeader(r)
+	if err != nil {
+		return err
+	}
+	m, err := resolveStsColumns(header)
+	if err != nil {
+		return err
+	}
+	record, err := r.Read()
+	if err == io.EOF {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	_, err = m.row(record)
+	return err
+}
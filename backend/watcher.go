@@ -0,0 +1,125 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+var watchEnabled bool
+var watchDebounce time.Duration
+var stsPollInterval time.Duration
+var igsPollInterval time.Duration
+var pollSettings map[string]string
+
+// WatchFiles=falseの場合は従来どおり一定間隔(既定 STS:90秒 IGS:30秒)で読み込む
+// 監視する場合の定期読み込みは取りこぼし対策のみのため既定5分
+func loadWatchSettings(settings map[string]string) error {
+	watchEnabled = settings["WatchFiles"] != "false"
+	pollSettings = settings
+	var err error
+	if watchDebounce, err = durationSetting(settings, "WatchDebounce", 3*time.Second); err != nil {
+		return err
+	}
+	if watchEnabled {
+		if stsPollInterval, err = durationSetting(settings, "STSPollInterval", 5*time.Minute); err != nil {
+			return err
+		}
+		if igsPollInterval, err = durationSetting(settings, "IGSPollInterval", 5*time.Minute); err != nil {
+			return err
+		}
+		return nil
+	}
+	return usePollingIntervals()
+}
+
+// 監視しない場合の読み込み間隔
+func usePollingIntervals() error {
+	var err error
+	if stsPollInterval, err = durationSetting(pollSettings, "STSPollInterval", 90*time.Second); err != nil {
+		return err
+	}
+	igsPollInterval, err = durationSetting(pollSettings, "IGSPollInterval", 30*time.Second)
+	return err
+}
+
+// 値は"90s","5m"などの形式
+func durationSetting(settings map[string]string, key string, def time.Duration) (time.Duration, error) {
+	if settings[key] == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(settings[key])
+	if err != nil || d <= 0 {
+		return 0, errors.New(key + "が不正です:" + settings[key])
+	}
+	return d, nil
+}
+
+// 変更されたファイルの取り込み元
+func feedSourceOf(name string) string {
+	base := filepath.Base(name)
+	if strings.EqualFold(base, filepath.Base(stsFilePath)) && strings.EqualFold(filepath.Dir(name), filepath.Dir(stsFilePath)) {
+		return "sts"
+	}
+	if strings.EqualFold(filepath.Dir(name), filepath.Clean(igsFolderPath)) && (strings.HasPrefix(base, igsFileName) || strings.HasPrefix(base, igsBLNOFileName)) {
+		return "igs"
+	}
+	return ""
+}
+
+// STSファイルとIGSフォルダの変更を監視し、書き込みが落ち着いてから取り込み元("sts","igs")を通知する
+func watchFeeds() (<-chan string, error) {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	dirs := map[string]bool{filepath.Dir(stsFilePath): true, filepath.Clean(igsFolderPath): true}
+	for dir := range dirs {
+		if err := w.Add(dir); err != nil {
+			w.Close()
+			return nil, err
+		}
+	}
+	out := make(chan string, 2)
+	go func() {
+		defer w.Close()
+		timers := make(map[string]*time.Timer)
+		fire := make(chan string)
+		for {
+			select {
+			case ev, ok := <-w.Events:
+				if !ok {
+					return
+				}
+				if ev.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) == 0 {
+					continue
+				}
+				src := feedSourceOf(ev.Name)
+				if src == "" {
+					continue
+				}
+				if t, ok := timers[src]; ok {
+					t.Reset(watchDebounce)
+				} else {
+					timers[src] = time.AfterFunc(watchDebounce, func() { fire <- src })
+				}
+			case src := <-fire:
+				//未処理の通知があれば重ねて送らない
+				select {
+				case out <- src:
+				default:
+				}
+			case err, ok := <-w.Errors:
+				if !ok {
+					return
+				}
+				log.Printf("ファイル監視でエラーが発生しました:%s", err)
+			}
+		}
+	}()
+	return out, nil
+}
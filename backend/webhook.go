@@ -0,0 +1,320 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// 通知の種類
+const (
+	webhookAlertOpen     = "alert.open"
+	webhookAlertResolved = "alert.resolved"
+	webhookStatusReached = "status.reached"
+)
+
+// 送信先ごとに溜めておける通知の数。溢れた分は送らずにdead letterへ書き出す
+const webhookQueueSize = 1000
+
+// 署名はリクエスト本文をWebhookNSecretでHMAC-SHA256したもの
+const webhookSignatureHeader = "X-STSChecker-Signature"
+
+type WebhookEvent struct {
+	Type   string     `json:"type"`
+	Time   time.Time  `json:"time"`
+	Text   string     `json:"text"`
+	Alert  *Alert     `json:"alert,omitempty"`
+	Status *AwbStatus `json:"status,omitempty"`
+}
+
+// Formatはjson(WebhookEventのまま)、slack、teams
+// Eventsはalert(アラートの発生・解決)と、status:72(ステータス72になった)をカンマ区切りで指定する
+type webhook struct {
+	Name     string
+	URL      string
+	Format   string
+	Secret   string
+	Alerts   bool
+	Statuses map[string]bool
+	queue    chan WebhookEvent
+}
+
+type deadLetter struct {
+	Time     time.Time    `json:"time"`
+	Webhook  string       `json:"webhook"`
+	URL      string       `json:"url"`
+	Attempts int          `json:"attempts"`
+	Error    string       `json:"error"`
+	Event    WebhookEvent `json:"event"`
+}
+
+var webhooks []*webhook
+var webhookRetries int
+var webhookTimeout time.Duration
+var webhookDeadLetterPath string
+var webhookClient *http.Client
+var deadLetterMu sync.Mutex
+
+var promWebhookTotal = promFactory.NewCounterVec(prometheus.CounterOpts{
+	Name: "stschecker_webhook_deliveries_total",
+	Help: "Webhookの送信結果",
+}, []string{"webhook", "result"})
+
+// Webhook1URL,Webhook1Format,Webhook1Events,Webhook1Secret から番号順に読み込む。番号が途切れたら終わり
+// WebhookRetries=送信を試みる回数(既定5回)、WebhookTimeout=1回の送信のタイムアウト(既定10秒)
+// WebhookDeadLetterPath=送信できなかった通知を書き出すファイル(既定webhook_deadletter.log)
+func loadWebhookSettings(settings map[string]string) error {
+	var err error
+	webhooks = make([]*webhook, 0, 2)
+	for i := 1; ; i++ {
+		name := "Webhook" + strconv.Itoa(i)
+		rawurl := settings[name+"URL"]
+		if rawurl == "" {
+			break
+		}
+		u, err := url.Parse(rawurl)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return errors.New(name + "URLが不正です:" + rawurl)
+		}
+		hook := &webhook{Name: name, URL: rawurl, Format: settings[name+"Format"], Secret: settings[name+"Secret"], Statuses: make(map[string]bool)}
+		switch hook.Format {
+		case "":
+			hook.Format = "json"
+		case "json", "slack", "teams":
+		default:
+			return errors.New(name + "Formatはjson,slack,teamsのいずれかを指定してください:" + hook.Format)
+		}
+		events := settings[name+"Events"]
+		if events == "" {
+			events = "alert"
+		}
+		for _, ev := range strings.Split(events, ",") {
+			ev = strings.TrimSpace(ev)
+			switch {
+			case ev == "alert":
+				hook.Alerts = true
+			case strings.HasPrefix(ev, "status:") && len(ev) > len("status:"):
+				hook.Statuses[strings.TrimPrefix(ev, "status:")] = true
+			default:
+				return errors.New(name + "Eventsが不正です:" + ev)
+			}
+		}
+		webhooks = append(webhooks, hook)
+	}
+	webhookRetries = 5
+	if v := settings["WebhookRetries"]; v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return errors.New("WebhookRetriesが不正です:" + v)
+		}
+		webhookRetries = n
+	}
+	if webhookTimeout, err = durationSetting(settings, "WebhookTimeout", 10*time.Second); err != nil {
+		return err
+	}
+	webhookDeadLetterPath = settings["WebhookDeadLetterPath"]
+	if webhookDeadLetterPath == "" {
+		webhookDeadLetterPath = "webhook_deadletter.log"
+	}
+	return nil
+}
+
+// 送信先ごとにgoroutineを起動する。遅い送信先があっても他の送信先は待たせない
+func startWebhooks() {
+	webhookClient = &http.Client{Timeout: webhookTimeout}
+	for _, hook := range webhooks {
+		hook.queue = make(chan WebhookEvent, webhookQueueSize)
+		go hook.run()
+	}
+}
+
+func (h *webhook) matches(ev WebhookEvent) bool {
+	switch ev.Type {
+	case webhookAlertOpen, webhookAlertResolved:
+		return h.Alerts
+	case webhookStatusReached:
+		return h.Statuses[ev.Status.StatusCode]
+	}
+	return false
+}
+
+func (h *webhook) run() {
+	for ev := range h.queue {
+		h.deliver(ev)
+	}
+}
+
+// 失敗した場合は待ち時間を延ばしながらWebhookRetries回まで試みる
+func (h *webhook) deliver(ev WebhookEvent) {
+	body, err := h.payload(ev)
+	if err != nil {
+		h.deadLetter(ev, 0, err)
+		return
+	}
+	for attempt := 1; ; attempt++ {
+		err = h.post(body)
+		if err == nil {
+			promWebhookTotal.WithLabelValues(h.Name, "success").Inc()
+			return
+		}
+		if attempt >= webhookRetries {
+			h.deadLetter(ev, attempt, err)
+			return
+		}
+		wait := retryBackoff(attempt)
+		log.Printf("Webhookの送信に失敗しました(%s %d回目)。%s後に再試行します:%s", h.Name, attempt, wait, err)
+		time.Sleep(wait)
+	}
+}
+
+func (h *webhook) post(body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, h.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	if h.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(h.Secret))
+		mac.Write(body)
+		req.Header.Set(webhookSignatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	res, err := webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return errors.New("Webhookの送信先がエラーを返しました:" + res.Status)
+	}
+	return nil
+}
+
+func (h *webhook) payload(ev WebhookEvent) ([]byte, error) {
+	switch h.Format {
+	case "slack":
+		return json.Marshal(map[string]string{"text": ev.Text})
+	case "teams":
+		return json.Marshal(map[string]string{
+			"@type":    "MessageCard",
+			"@context": "https://schema.org/extensions",
+			"summary":  ev.Text,
+			"text":     ev.Text,
+		})
+	}
+	return json.Marshal(ev)
+}
+
+// 送信できなかった通知は1行1件のJSONで追記する
+func (h *webhook) deadLetter(ev WebhookEvent, attempts int, cause error) {
+	promWebhookTotal.WithLabelValues(h.Name, "dead_letter").Inc()
+	log.Printf("Webhookを送信できませんでした(%s)。%sに書き出します:%s", h.Name, webhookDeadLetterPath, cause)
+	line, err := json.Marshal(deadLetter{Time: time.Now(), Webhook: h.Name, URL: h.URL, Attempts: attempts, Error: cause.Error(), Event: ev})
+	if err != nil {
+		//通知の内容を出力できない場合も本文とエラーだけは残す
+		log.Printf("%s", err)
+		line, err = json.Marshal(map[string]interface{}{
+			"time":     time.Now(),
+			"webhook":  h.Name,
+			"url":      h.URL,
+			"attempts": attempts,
+			"error":    cause.Error() + " / " + err.Error(),
+			"type":     ev.Type,
+			"text":     ev.Text,
+		})
+		if err != nil {
+			log.Printf("%s", err)
+			return
+		}
+	}
+	deadLetterMu.Lock()
+	defer deadLetterMu.Unlock()
+	file, err := os.OpenFile(webhookDeadLetterPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		log.Printf("%s", err)
+		return
+	}
+	defer file.Close()
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		log.Printf("%s", err)
+	}
+}
+
+// 取り込みのgoroutineから呼ぶため、送信を待たずに戻る
+func notifyWebhooks(events []WebhookEvent) {
+	for _, ev := range events {
+		for _, hook := range webhooks {
+			if !hook.matches(ev) {
+				continue
+			}
+			select {
+			case hook.queue <- ev:
+			default:
+				hook.deadLetter(ev, 0, errors.New("送信待ちの通知が多すぎます"))
+			}
+		}
+	}
+}
+
+func alertWebhookEvents(changed []Alert) []WebhookEvent {
+	events := make([]WebhookEvent, 0, len(changed))
+	for i := range changed {
+		a := changed[i]
+		ev := WebhookEvent{Type: webhookAlertOpen, Time: a.OpenedAt, Alert: &a}
+		ev.Text = fmt.Sprintf("[アラート] %s AWB:%s %s", a.Label, a.Awbno, a.Message)
+		if a.State == alertResolved {
+			ev.Type, ev.Time = webhookAlertResolved, *a.ResolvedAt
+			ev.Text = fmt.Sprintf("[解決] %s AWB:%s", a.Label, a.Awbno)
+		}
+		events = append(events, ev)
+	}
+	return events
+}
+
+// 前回の取り込みから通知対象のステータスに変わったAWB。起動して最初の取り込みでは通知しない
+func statusWebhookEvents(prev *Snapshot, cur map[string]AwbStatus, now time.Time) []WebhookEvent {
+	events := make([]WebhookEvent, 0, 10)
+	if prev.Version < 1 {
+		return events
+	}
+	watched := make(map[string]bool)
+	for _, hook := range webhooks {
+		for code := range hook.Statuses {
+			watched[code] = true
+		}
+	}
+	if len(watched) < 1 {
+		return events
+	}
+	for awb, c := range cur {
+		if !watched[c.StatusCode] {
+			continue
+		}
+		if p, ok := prev.Awbs[awb]; ok && p.StatusCode == c.StatusCode {
+			continue
+		}
+		status := c
+		events = append(events, WebhookEvent{
+			Type:   webhookStatusReached,
+			Time:   now,
+			Text:   fmt.Sprintf("[ステータス] AWB:%s が%sになりました(%s %s)", awb, c.StatusCode, c.CompanyName, c.SectionCode),
+			Status: &status,
+		})
+	}
+	sort.SliceStable(events, func(i, j int) bool { return events[i].Status.Awbno < events[j].Status.Awbno })
+	return events
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWebhookStatusReached(t *testing.T) {
+	got := make(chan []byte, 4)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		mac := hmac.New(sha256.New, []byte("secret"))
+		mac.Write(b)
+		if r.Header.Get(webhookSignatureHeader) != "sha256="+hex.EncodeToString(mac.Sum(nil)) {
+			t.Error("署名が違います")
+		}
+		got <- b
+	}))
+	defer srv.Close()
+	defer func() { webhooks = nil }()
+	deadletter := filepath.Join(t.TempDir(), "deadletter.log")
+	if err := loadWebhookSettings(map[string]string{
+		"Webhook1URL":           srv.URL,
+		"Webhook1Secret":        "secret",
+		"Webhook1Events":        "alert,status:72",
+		"WebhookRetries":        "1",
+		"WebhookDeadLetterPath": deadletter,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	startWebhooks()
+
+	_, statuses := stsRowStatuses([]stsRow{{Awb: "11111111", Branch: "0", Status: "72"}}, map[string]string{}, time.Now().UnixMilli())
+	prev := &Snapshot{Version: 1, Awbs: map[string]AwbStatus{"11111111": {Awbno: "11111111", StatusCode: "70"}}}
+	events := statusWebhookEvents(prev, map[string]AwbStatus{"11111111": statuses[0]}, time.Now())
+	if len(events) != 1 {
+		t.Fatalf("通知が違います:%+v", events)
+	}
+	notifyWebhooks(events)
+	select {
+	case b := <-got:
+		var ev WebhookEvent
+		if err := json.Unmarshal(b, &ev); err != nil {
+			t.Fatal(err)
+		}
+		if ev.Type != webhookStatusReached || ev.Status.Awbno != "11111111" {
+			t.Fatalf("通知が違います:%s", b)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("通知が届きません")
+	}
+	if _, err := ioutil.ReadFile(deadletter); err == nil {
+		t.Fatal("dead letterに書き出されています")
+	}
+}
+
+func TestWebhookDeadLetterFallback(t *testing.T) {
+	webhookDeadLetterPath = filepath.Join(t.TempDir(), "deadletter.log")
+	hook := &webhook{Name: "Webhook1", URL: "http://127.0.0.1:1/"}
+	//JSONにできない時刻を含む通知
+	ev := WebhookEvent{Type: webhookStatusReached, Time: time.Unix(1<<40, 0), Text: "AWB:11111111"}
+	hook.deadLetter(ev, 3, errors.New("送信できません"))
+	b, err := ioutil.ReadFile(webhookDeadLetterPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Count(string(b), "\n") != 1 || !strings.Contains(string(b), "AWB:11111111") || !strings.Contains(string(b), "送信できません") {
+		t.Fatalf("dead letterが違います:%s", b)
+	}
+}